@@ -0,0 +1,217 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ParseConfigCommands parses a series of invocations of the kernel's
+// scripts/config tool, such as
+//
+//	scripts/config --enable SMP --module E1000 --set-val NR_CPUS 64
+//
+// and returns the diff which the commands would produce if applied to
+// base, i.e. a diff such that base.ApplyDiff succeeds. Each line of the
+// input holds the arguments to one invocation, quoted as in a POSIX shell.
+// The leading program name is optional. Blank lines, and lines starting
+// with '#', are ignored.
+//
+// As in scripts/config, option names may include the CONFIG_ prefix, and
+// are converted to upper case, unless --keep-case is in effect.
+//
+// Options which are set by --enable, --disable, --module, --set-str or
+// --set-val, and their -after variants, are reported in InNew if they are
+// not present in base, and in Changes if they are present with a different
+// value. Options which are removed by --undefine are reported in InOld, if
+// they are present in base. Commands which leave an option as it is in
+// base are not reported. If an option is mentioned more than once, the
+// last command wins. Queries, such as --state, and --file, are ignored.
+func ParseConfigCommands(r io.Reader, base Config) (ConfigDiff, error) {
+	cp := &commandParser{Vals: make(map[string]string)}
+	sc := bufio.NewScanner(r)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, err := splitShellWords(line)
+		if err != nil {
+			return ConfigDiff{}, xerrors.Errorf("linuxkernel: line %d: %w", lineno, err)
+		}
+		if err := cp.Invoke(args); err != nil {
+			return ConfigDiff{}, xerrors.Errorf("linuxkernel: line %d: %w", lineno, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return ConfigDiff{}, err
+	}
+
+	changes := make([]ConfigValue, 0, len(cp.Vals))
+	for opt, val := range cp.Vals {
+		changes = append(changes, ConfigValue{Opt: opt, Val: val})
+	}
+	return DiffConfig(base, base.Apply(changes...)), nil
+}
+
+// commandParser interprets scripts/config invocations.
+type commandParser struct {
+	// Vals holds the final value of each option, or Removed.
+	Vals map[string]string
+}
+
+// Invoke interprets the arguments to a single invocation of scripts/config.
+func (cp *commandParser) Invoke(args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") && strings.HasSuffix(args[0], "config") {
+		args = args[1:]
+	}
+	keepCase := false
+	// need returns the n arguments following the command at args[0].
+	need := func(n int) ([]string, error) {
+		if len(args) < n+1 {
+			return nil, xerrors.Errorf("%s: got %d arguments, want %d", args[0], len(args)-1, n)
+		}
+		return args[1 : n+1], nil
+	}
+	for len(args) > 0 {
+		cmd := args[0]
+		var (
+			operands []string
+			err      error
+		)
+		switch cmd {
+		case "--keep-case", "-k":
+			keepCase = true
+		case "--file":
+			operands, err = need(1)
+		case "--state", "-s":
+			operands, err = need(1)
+		case "--enable", "-e":
+			operands, err = need(1)
+			cp.set(operands, 0, "y", keepCase)
+		case "--disable", "-d":
+			operands, err = need(1)
+			cp.set(operands, 0, "n", keepCase)
+		case "--module", "-m":
+			operands, err = need(1)
+			cp.set(operands, 0, "m", keepCase)
+		case "--undefine", "-u":
+			operands, err = need(1)
+			cp.set(operands, 0, Removed, keepCase)
+		case "--enable-after", "-E":
+			operands, err = need(2)
+			cp.set(operands, 1, "y", keepCase)
+		case "--disable-after", "-D":
+			operands, err = need(2)
+			cp.set(operands, 1, "n", keepCase)
+		case "--module-after", "-M":
+			operands, err = need(2)
+			cp.set(operands, 1, "m", keepCase)
+		case "--set-str":
+			operands, err = need(2)
+			if err == nil {
+				cp.set(operands, 0, QuoteValue(operands[1]), keepCase)
+			}
+		case "--set-val":
+			operands, err = need(2)
+			if err == nil {
+				cp.set(operands, 0, operands[1], keepCase)
+			}
+		default:
+			return xerrors.Errorf("unknown command %q", cmd)
+		}
+		if err != nil {
+			return err
+		}
+		args = args[1+len(operands):]
+	}
+	return nil
+}
+
+// set sets the option named by operands[i] to val, if operands is long
+// enough. Short operand lists are reported by Invoke.
+func (cp *commandParser) set(operands []string, i int, val string, keepCase bool) {
+	if i >= len(operands) {
+		return
+	}
+	opt := operands[i]
+	if !keepCase {
+		opt = strings.ToUpper(opt)
+	}
+	opt = strings.TrimPrefix(opt, "CONFIG_")
+	cp.Vals[opt] = val
+}
+
+// splitShellWords splits line into words, as a POSIX shell would, honoring
+// single quotes, double quotes and backslash escapes. Variable expansion
+// and other substitutions are not supported.
+func splitShellWords(line string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			i++
+			if i == len(line) {
+				return nil, xerrors.New("trailing backslash")
+			}
+			word.WriteByte(line[i])
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, xerrors.New("unterminated single quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += 1 + end
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, xerrors.New("unterminated double quote")
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
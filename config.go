@@ -15,40 +15,424 @@
 package linuxkernel
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strings"
+
+	"golang.org/x/xerrors"
 )
 
 // Config represents a parsed Linux kernel configuration file.
 //
 // Given a value cfg of type Config:
 //
-// * for CONFIG_X=something, cfg["X"] == "bar"
+// * for CONFIG_X=something, cfg["X"] == "something"
 //
-// * for CONFIG_Y="", cfg["Y"] == "".
+// * for CONFIG_Y="", cfg["Y"] == `""`.
 //
 // * for # CONFIG_Z is not set, cfg["Z"] == "n".
+//
+// Values are stored exactly as they appear in the configuration file. In
+// particular, string values retain their surrounding quotes, so the
+// canonical representation of an empty string value is `""`, not the empty
+// Go string. See EqualNormalized for a comparison which does not
+// distinguish between the two.
 type Config map[string]string
 
+var (
+	_ io.WriterTo = Config(nil)
+	_ io.WriterTo = ConfigDiff{}
+)
+
 // ParseConfig parses a Config from r. It reads from r until EOF. ParseConfig
 // assumes that its input is a well-formed kernel configuration file: its
-// behavior is undefined otherwise.
+// behavior is undefined otherwise. A leading UTF-8 byte order mark, as
+// written by some tools, is ignored.
 func ParseConfig(r io.Reader) (Config, error) {
+	cfg, _, err := parseConfig(r, false)
+	return cfg, err
+}
+
+// ParseConfigExtra is like ParseConfig, but it also returns the lines which
+// look like assignments of the form KEY=value, but which do not assign a
+// CONFIG_ option, and are therefore ignored by ParseConfig. The lines are
+// returned verbatim, in the order in which they appear in the input.
+func ParseConfigExtra(r io.Reader) (Config, []string, error) {
+	return parseConfig(r, true)
+}
+
+// parseConfig implements ParseConfig and ParseConfigExtra. Extra lines are
+// only collected if collectExtra is true.
+func parseConfig(r io.Reader, collectExtra bool) (Config, []string, error) {
 	cfg := make(Config)
+	var extra []string
 	sc := bufio.NewScanner(r)
+	first := true
 	for sc.Scan() {
-		opt, val := parseConfigLine(sc.Text())
+		line := sc.Text()
+		if first {
+			line = strings.TrimPrefix(line, byteOrderMark)
+			first = false
+		}
+		opt, val := parseConfigLine(line)
 		if opt != "" {
 			cfg[opt] = val
+		} else if collectExtra && isExtraAssignment(line) {
+			extra = append(extra, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, extra, nil
+}
+
+// isExtraAssignment returns true if line looks like an assignment of the
+// form KEY=value, where KEY is not a CONFIG_ option.
+func isExtraAssignment(line string) bool {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "CONFIG_") {
+		return false
+	}
+	eq := strings.Index(line, "=")
+	if eq <= 0 {
+		return false
+	}
+	key := strings.TrimSpace(line[:eq])
+	return key != "" && !strings.ContainsAny(key, " \t")
+}
+
+// ParseConfigs parses several configurations concatenated into a single
+// stream, each introduced by a marker line. A marker line is a line which
+// starts with marker, after leading whitespace is trimmed. The rest of the
+// line, with surrounding whitespace trimmed, is the name of the
+// configuration which follows. For example, if marker is "### config:",
+// then the line "### config: x86_64-debug" introduces a configuration named
+// "x86_64-debug". The configurations are parsed as by ParseConfig.
+//
+// Blank lines and comments before the first marker line are ignored,
+// but options are an error, as are empty and duplicate names.
+func ParseConfigs(r io.Reader, marker string) (map[string]Config, error) {
+	if marker == "" {
+		return nil, xerrors.Errorf("linuxkernel: empty marker")
+	}
+	configs := make(map[string]Config)
+	var cur Config
+	sc := bufio.NewScanner(r)
+	first := true
+	for sc.Scan() {
+		line := sc.Text()
+		if first {
+			line = strings.TrimPrefix(line, byteOrderMark)
+			first = false
+		}
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, marker) {
+			name := strings.TrimSpace(strings.TrimPrefix(trimmed, marker))
+			if name == "" {
+				return nil, xerrors.Errorf("linuxkernel: marker line %q has no name", line)
+			}
+			if _, ok := configs[name]; ok {
+				return nil, xerrors.Errorf("linuxkernel: duplicate configuration %q", name)
+			}
+			cur = make(Config)
+			configs[name] = cur
+			continue
+		}
+		opt, val := parseConfigLine(line)
+		if opt == "" {
+			continue
+		}
+		if cur == nil {
+			return nil, xerrors.Errorf("linuxkernel: option %s before first marker line", opt)
+		}
+		cur[opt] = val
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// LoadConfigs parses the configuration files at the specified paths, in
+// order, and merges them. If an option is set in more than one file, the
+// value from the last such file takes precedence. This is useful for
+// assembling a configuration from multiple fragments.
+func LoadConfigs(paths ...string) (Config, error) {
+	merged := make(Config)
+	for _, path := range paths {
+		cfg, err := parseConfigFile(path)
+		if err != nil {
+			return nil, xerrors.Errorf("linuxkernel: failed to load %s: %w", path, err)
+		}
+		for opt, val := range cfg {
+			merged[opt] = val
+		}
+	}
+	return merged, nil
+}
+
+// ParseConfigWithIncludes parses a configuration composed of fragments
+// which include each other. The top level fragment is the one named by path.
+//
+// Fragments are opened by calling resolve with their name. If the returned
+// io.Reader also implements io.Closer, it is closed once the fragment has
+// been parsed. A line of the form
+//
+//	# include NAME
+//
+// includes the fragment with the specified name at that point. The name may
+// optionally be enclosed in angle brackets. Values are merged in the order
+// in which they are encountered, such that the last value of an option wins.
+// A fragment may be included more than once, but cyclic includes are
+// an error.
+func ParseConfigWithIncludes(path string, resolve func(string) (io.Reader, error)) (Config, error) {
+	ip := &includeParser{
+		Resolve: resolve,
+		Cfg:     make(Config),
+	}
+	if err := ip.Parse(path); err != nil {
+		return nil, err
+	}
+	return ip.Cfg, nil
+}
+
+type includeParser struct {
+	Resolve func(string) (io.Reader, error)
+	Cfg     Config
+	Stack   []string // names of the fragments being parsed
+}
+
+func (ip *includeParser) Parse(name string) error {
+	for _, active := range ip.Stack {
+		if active == name {
+			chain := append(ip.Stack, name)
+			return xerrors.Errorf("linuxkernel: include cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	ip.Stack = append(ip.Stack, name)
+	defer func() {
+		ip.Stack = ip.Stack[:len(ip.Stack)-1]
+	}()
+
+	r, err := ip.Resolve(name)
+	if err != nil {
+		return xerrors.Errorf("linuxkernel: failed to resolve %s: %w", name, err)
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	sc := bufio.NewScanner(r)
+	first := true
+	for sc.Scan() {
+		line := sc.Text()
+		if first {
+			line = strings.TrimPrefix(line, byteOrderMark)
+			first = false
+		}
+		if include, ok := parseIncludeLine(line); ok {
+			if err := ip.Parse(include); err != nil {
+				return err
+			}
+			continue
+		}
+		if opt, val := parseConfigLine(line); opt != "" {
+			ip.Cfg[opt] = val
 		}
 	}
 	if err := sc.Err(); err != nil {
+		return xerrors.Errorf("linuxkernel: failed to read %s: %w", name, err)
+	}
+	return nil
+}
+
+// parseIncludeLine parses an include directive of the form
+// "# include NAME" or "# include <NAME>". It returns the name, and a
+// boolean indicating whether the line is an include directive.
+func parseIncludeLine(line string) (name string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#") {
+		return "", false
+	}
+	line = strings.TrimLeft(strings.TrimPrefix(line, "#"), " \t")
+	if !strings.HasPrefix(line, "include ") && !strings.HasPrefix(line, "include\t") {
+		return "", false
+	}
+	name = strings.TrimSpace(strings.TrimPrefix(line, "include"))
+	if strings.HasPrefix(name, "<") && strings.HasSuffix(name, ">") {
+		name = name[1 : len(name)-1]
+	}
+	return name, name != ""
+}
+
+// RunningConfig calls RunningConfigFrom("/proc/config.gz").
+func RunningConfig() (Config, error) {
+	return RunningConfigFrom("/proc/config.gz")
+}
+
+// RunningConfigFrom reads the configuration of the running kernel from the
+// specified path. The path should indicate /proc/config.gz, or the
+// equivalent file if procfs is mounted elsewhere. The file is only
+// available if the kernel was built with CONFIG_IKCONFIG_PROC=y.
+func RunningConfigFrom(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, xerrors.Errorf("linuxkernel: failed to decompress %s: %w", path, err)
+	}
+	defer zr.Close()
+
+	return ParseConfig(zr)
+}
+
+// gzipMagic is the magic number at the start of gzip streams.
+const gzipMagic = "\x1f\x8b"
+
+// ParseConfigAuto is like ParseConfig, but if the input is compressed using
+// gzip, as is /proc/config.gz, it is decompressed first. The input is
+// recognized by the gzip magic number at its start.
+func ParseConfigAuto(r io.Reader) (Config, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) != gzipMagic {
+		return ParseConfig(br)
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, xerrors.Errorf("linuxkernel: failed to decompress configuration: %w", err)
+	}
+	defer zr.Close()
+
+	return ParseConfig(zr)
+}
+
+// ParseConfigFromTar scans the tar archive read from r for a regular file
+// with the specified name, and parses it as a configuration file. If name
+// is empty, it defaults to ".config".
+//
+// An entry matches if its cleaned path is equal to name, or if it ends in
+// "/" followed by name. For example, the name ".config" matches the entry
+// "linux-5.1/.config", which is useful for tarballs of source trees, which
+// usually contain a top level directory. The first matching entry is used.
+func ParseConfigFromTar(r io.Reader, name string) (Config, error) {
+	if name == "" {
+		name = ".config"
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, xerrors.Errorf("linuxkernel: %s not found in tar archive", name)
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("linuxkernel: failed to read tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		entry := path.Clean(hdr.Name)
+		if entry == name || strings.HasSuffix(entry, "/"+name) {
+			return ParseConfig(tr)
+		}
+	}
+}
+
+// DiffAgainstRunning computes the differences between the configuration of
+// the running kernel, as read by RunningConfig, and cfg. Entries in the InOld
+// slice of the diff are only present in the running configuration, and
+// entries in the InNew slice are only present in cfg.
+//
+// If the running configuration is not available, DiffAgainstRunning returns
+// an error which wraps the error returned by RunningConfig.
+func DiffAgainstRunning(cfg Config) (ConfigDiff, error) {
+	return diffAgainstRunningFrom("/proc/config.gz", cfg)
+}
+
+func diffAgainstRunningFrom(path string, cfg Config) (ConfigDiff, error) {
+	running, err := RunningConfigFrom(path)
+	if err != nil {
+		return ConfigDiff{}, xerrors.Errorf("linuxkernel: running kernel configuration not available: %w", err)
+	}
+	return DiffConfig(running, cfg), nil
+}
+
+// parseConfigFile parses the configuration file at the specified path.
+func parseConfigFile(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
 		return nil, err
 	}
-	return cfg, nil
+	defer f.Close()
+
+	return ParseConfig(f)
+}
+
+// byteOrderMark is the UTF-8 encoding of the Unicode byte order mark.
+const byteOrderMark = "\ufeff"
+
+// ConfigBuilder builds a Config by way of method chaining. For example:
+//
+//	cfg := NewConfigBuilder().
+//		Enable("SMP").
+//		Disable("DEBUG_INFO").
+//		Module("EXT4_FS").
+//		Set("NR_CPUS", "64").
+//		Build()
+//
+// If an option is set more than once, the last value wins.
+type ConfigBuilder struct {
+	cfg Config
+}
+
+// NewConfigBuilder returns a ConfigBuilder for an empty configuration.
+func NewConfigBuilder() *ConfigBuilder {
+	return &ConfigBuilder{cfg: make(Config)}
+}
+
+// Enable sets opt to "y".
+func (b *ConfigBuilder) Enable(opt string) *ConfigBuilder {
+	return b.Set(opt, TristateYes.String())
+}
+
+// Module sets opt to "m".
+func (b *ConfigBuilder) Module(opt string) *ConfigBuilder {
+	return b.Set(opt, TristateModule.String())
+}
+
+// Disable sets opt to "n".
+func (b *ConfigBuilder) Disable(opt string) *ConfigBuilder {
+	return b.Set(opt, TristateNo.String())
+}
+
+// Set sets opt to val. The value is used verbatim: string values must be
+// quoted.
+func (b *ConfigBuilder) Set(opt, val string) *ConfigBuilder {
+	b.cfg[opt] = val
+	return b
+}
+
+// Build returns the configuration built so far. The returned Config is
+// independent of the builder: further calls to the builder's methods do
+// not affect it.
+func (b *ConfigBuilder) Build() Config {
+	return b.cfg.clone()
 }
 
 // parseConfigLine parses a line from a kernel config file.
@@ -58,22 +442,36 @@ func ParseConfig(r io.Reader) (Config, error) {
 // "HAVE_KERNEL_GZIP", "y".
 //
 // For the line "# CONFIG_COMPILE_TEST is not set", it returns the pair
-// "COMPILE_TEST", "n".
+// "COMPILE_TEST", "n". Variations in the spacing after the "#", as well
+// as a missing "#", are tolerated.
 //
 // For any other types of lines, such as "# General setup", it returns
 // empty strings.
 func parseConfigLine(line string) (opt, val string) {
 	line = strings.TrimSpace(line)
+	// A line such as "CONFIG_X=foo is not set" is an assignment, not a
+	// disabled option, so only consider lines without '=' here.
+	if strings.HasSuffix(line, " is not set") && !strings.Contains(line, "=") {
+		disabled := strings.TrimSuffix(line, " is not set")
+		disabled = strings.TrimPrefix(disabled, "#")
+		disabled = strings.TrimLeft(disabled, " \t")
+		if !strings.HasPrefix(disabled, "CONFIG_") {
+			return "", ""
+		}
+		opt = strings.TrimPrefix(disabled, "CONFIG_")
+		if opt == "" || strings.ContainsAny(opt, " \t") {
+			return "", ""
+		}
+		return opt, "n"
+	}
 	if strings.HasPrefix(line, "CONFIG_") {
 		line = strings.TrimPrefix(line, "CONFIG_")
-		tokens := strings.Split(line, "=")
+		tokens := strings.SplitN(line, "=", 2)
+		if len(tokens) != 2 {
+			return "", ""
+		}
 		return tokens[0], tokens[1]
 	}
-	if strings.HasSuffix(line, " is not set") {
-		line = strings.TrimSuffix(line, " is not set")
-		line = strings.TrimPrefix(line, "# CONFIG_")
-		return line, "n"
-	}
 	return "", ""
 }
 
@@ -81,16 +479,94 @@ func parseConfigLine(line string) (opt, val string) {
 // kernel configuration file, but it is almost certainly different from
 // the original file the Config was parsed from.
 func (cfg Config) WriteTo(w io.Writer) (int64, error) {
+	cfgw := &configWriter{W: w}
+	for _, opt := range cfg.sortedOptions() {
+		cfgw.WriteLine(opt, cfg[opt])
+	}
+	return cfgw.N, cfgw.Err
+}
+
+// WriteToExplicit is like WriteTo, but it writes disabled options as
+// "CONFIG_X=n" rather than "# CONFIG_X is not set". ParseConfig accepts
+// both forms.
+func (cfg Config) WriteToExplicit(w io.Writer) (int64, error) {
+	cfgw := &configWriter{W: w, Explicit: true}
+	for _, opt := range cfg.sortedOptions() {
+		cfgw.WriteLine(opt, cfg[opt])
+	}
+	return cfgw.N, cfgw.Err
+}
+
+// WriteMakefile writes cfg to w as a series of Makefile variable
+// assignments of the form "CONFIG_X := value", in sorted order, such that
+// the output can be included from a Makefile. Disabled options are omitted,
+// since make treats undefined variables as empty. String values retain
+// their quotes, as in the include/config/auto.conf file generated by the
+// kernel build system.
+func (cfg Config) WriteMakefile(w io.Writer) (int64, error) {
+	cfgw := &configWriter{W: w}
+	for _, opt := range cfg.sortedOptions() {
+		if val := cfg[opt]; val != "n" {
+			cfgw.WriteMakeLine(opt, val)
+		}
+	}
+	return cfgw.N, cfgw.Err
+}
+
+// MarshalText implements encoding.TextMarshaler. The output is the same
+// as that of WriteTo.
+func (cfg Config) MarshalText() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := cfg.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It parses text as
+// ParseConfig does, and replaces the contents of *cfg with the result.
+func (cfg *Config) UnmarshalText(text []byte) error {
+	parsed, err := ParseConfig(bytes.NewReader(text))
+	if err != nil {
+		return err
+	}
+	*cfg = parsed
+	return nil
+}
+
+// sortedOptions returns the options in cfg, in sorted order.
+func (cfg Config) sortedOptions() []string {
 	opts := make([]string, 0, len(cfg))
 	for opt := range cfg {
 		opts = append(opts, opt)
 	}
 	sort.Strings(opts)
-	cfgw := &configWriter{W: w}
-	for _, opt := range opts {
-		cfgw.WriteLine(opt, cfg[opt])
+	return opts
+}
+
+// ByValue returns an inverted index of cfg: it maps each distinct value in
+// cfg to the sorted list of options which have that value.
+func (cfg Config) ByValue() map[string][]string {
+	index := make(map[string][]string)
+	for _, opt := range cfg.sortedOptions() {
+		val := cfg[opt]
+		index[val] = append(index[val], opt)
 	}
-	return cfgw.N, cfgw.Err
+	return index
+}
+
+// Search returns the options in cfg whose name or value contains substr,
+// sorted by option name. The search is case-insensitive.
+func (cfg Config) Search(substr string) []ConfigValue {
+	substr = strings.ToLower(substr)
+	var matches []ConfigValue
+	for _, opt := range cfg.sortedOptions() {
+		val := cfg[opt]
+		if strings.Contains(strings.ToLower(opt), substr) || strings.Contains(strings.ToLower(val), substr) {
+			matches = append(matches, ConfigValue{Opt: opt, Val: val})
+		}
+	}
+	return matches
 }
 
 // Equal returns a boolean indicating whether cfg and the specified config
@@ -103,6 +579,117 @@ func (cfg Config) Equal(other Config) bool {
 	return cfg.containedIn(other) && other.containedIn(cfg)
 }
 
+// ConfigsDiffer reports whether DiffConfig(a, b) would find any differences
+// between a and b. It is cheaper than computing the diff: it does not
+// allocate, and it returns as soon as it finds a difference.
+func ConfigsDiffer(a, b Config) bool {
+	return len(a) != len(b) || !a.containedIn(b)
+}
+
+// ConfigSimilarity returns a similarity score between a and b, between 0
+// and 1. It is the Jaccard index of the sets of option=value pairs in a
+// and b: the number of options present in both with equal values, divided
+// by the number of distinct option names in either. An option present in
+// both but with different values counts towards the denominator only.
+// Identical configurations, including two empty ones, have similarity 1.
+// Configurations with no options in common have similarity 0.
+func ConfigSimilarity(a, b Config) float64 {
+	equal := 0
+	union := len(a)
+	for opt, val := range b {
+		aval, ok := a[opt]
+		if !ok {
+			union++
+			continue
+		}
+		if aval == val {
+			equal++
+		}
+	}
+	if union == 0 {
+		return 1
+	}
+	return float64(equal) / float64(union)
+}
+
+// ErrConfigsUnequal is matched by errors returned by AssertEqual, using
+// xerrors.Is(err, ErrConfigsUnequal).
+var ErrConfigsUnequal = xerrors.New("linuxkernel: configurations are not equal")
+
+// AssertEqual returns nil if cfg and other are Equal. Otherwise, it returns
+// an error whose message includes the differences between them, as computed
+// by DiffConfig(cfg, other), and written by ConfigDiff.WriteTo. This is
+// useful for producing informative failures in tests.
+func (cfg Config) AssertEqual(other Config) error {
+	if !ConfigsDiffer(cfg, other) {
+		return nil
+	}
+	return configsUnequalError{Diff: DiffConfig(cfg, other)}
+}
+
+// EqualNormalized is like Equal, but it considers the empty Go string and
+// the quoted empty string `""` to be the same value.
+func (cfg Config) EqualNormalized(other Config) bool {
+	return cfg.containedInNormalized(other) && other.containedInNormalized(cfg)
+}
+
+// containedInNormalized is like containedIn, but it compares normalized
+// values.
+func (cfg Config) containedInNormalized(other Config) bool {
+	for opt, val := range cfg {
+		otherval, ok := other[opt]
+		if !ok || normalizeEmpty(val) != normalizeEmpty(otherval) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeEmpty returns the canonical representation of val: the empty
+// Go string becomes the quoted empty string. Other values are returned
+// unchanged.
+func normalizeEmpty(val string) string {
+	if val == "" {
+		return `""`
+	}
+	return val
+}
+
+// Canonicalize returns a copy of cfg in which values are rewritten in a
+// canonical form, such that configurations which differ only in formatting
+// compare Equal after canonicalization. The rules are:
+//
+//   - the tristate values Y, M and N are lowercased
+//   - hexadecimal values have a lowercase 0x prefix and lowercase digits
+//   - string values are re-quoted, removing unnecessary escapes
+//   - the empty Go string becomes the quoted empty string, as
+//     in EqualNormalized
+//
+// Other values are left unchanged.
+func (cfg Config) Canonicalize() Config {
+	canonical := make(Config, len(cfg))
+	for opt, val := range cfg {
+		canonical[opt] = canonicalValue(val)
+	}
+	return canonical
+}
+
+// canonicalValue implements Canonicalize for a single value.
+func canonicalValue(val string) string {
+	switch lower := strings.ToLower(val); {
+	case val == "":
+		return normalizeEmpty(val)
+	case lower == "y" || lower == "m" || lower == "n":
+		return lower
+	case KindHex.matches(lower):
+		return lower
+	}
+	if s, err := UnquoteValue(val); err == nil {
+		return QuoteValue(s)
+	}
+	return val
+}
+
 // containedIn returns a boolean indicating whether all the options in cfg are
 // contained in the specified Config, and all the corresponding values match.
 func (cfg Config) containedIn(other Config) bool {
@@ -115,40 +702,568 @@ func (cfg Config) containedIn(other Config) bool {
 	return true
 }
 
-// ApplyDiff applies the specified diff to cfg and returns a new config, such
-// that, schematically, if x.ApplyDiff(d) == y, then DiffConfig(x, y) == d.
-func (cfg Config) ApplyDiff(diff ConfigDiff) (Config, error) {
+// Get returns the value of opt, or def if opt is not present in cfg.
+func (cfg Config) Get(opt, def string) string {
+	if val, ok := cfg[opt]; ok {
+		return val
+	}
+	return def
+}
+
+// GetFold is like a map lookup of opt in cfg, but if there is no exact
+// match, it falls back to comparing option names case-insensitively, under
+// Unicode case folding. If several options match opt in this way, the
+// value of the lexically smallest one is returned.
+//
+// An exact match takes constant time, but the fallback takes time
+// proportional to the size of cfg.
+func (cfg Config) GetFold(opt string) (val string, ok bool) {
+	if val, ok := cfg[opt]; ok {
+		return val, true
+	}
+	match := ""
+	for candidate := range cfg {
+		if !strings.EqualFold(candidate, opt) {
+			continue
+		}
+		if !ok || candidate < match {
+			match = candidate
+			ok = true
+		}
+	}
+	return cfg[match], ok
+}
+
+// IsEnabled returns a boolean indicating whether opt is enabled, i.e.
+// whether it is set to "y" or "m".
+func (cfg Config) IsEnabled(opt string) bool {
+	val := cfg[opt]
+	return val == "y" || val == "m"
+}
+
+// Forbid checks cfg against a list of forbidden option values, and returns
+// the violations, sorted by option name. An option violates the list if
+// its value in cfg is equal to the corresponding value in forbidden. For
+// example, if forbidden["DEVMEM"] == "y", then a configuration with
+// CONFIG_DEVMEM=y violates it. An empty result means that cfg complies.
+func (cfg Config) Forbid(forbidden map[string]string) []ConfigValue {
+	var violations []ConfigValue
+	for opt, bad := range forbidden {
+		if val, ok := cfg[opt]; ok && val == bad {
+			violations = append(violations, ConfigValue{Opt: opt, Val: val})
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].less(violations[j])
+	})
+	return violations
+}
+
+// Obsolete returns the sorted names of the options in cfg which are not
+// present in valid, e.g. because they have been removed from the Kconfig
+// files of a newer kernel. These are the options which make oldconfig
+// would silently drop.
+func (cfg Config) Obsolete(valid map[string]bool) []string {
+	var obsolete []string
+	for opt := range cfg {
+		if !valid[opt] {
+			obsolete = append(obsolete, opt)
+		}
+	}
+	sort.Strings(obsolete)
+	return obsolete
+}
+
+// NonDefault returns the options in cfg whose values differ from the
+// corresponding values in defaults, e.g. the defaults declared in Kconfig.
+// Options which are not present in defaults have no known default, and are
+// kept. The result approximates the output of make savedefconfig, without
+// taking dependencies between options into account.
+func (cfg Config) NonDefault(defaults map[string]string) Config {
+	nondefault := make(Config)
+	for opt, val := range cfg {
+		if def, ok := defaults[opt]; !ok || def != val {
+			nondefault[opt] = val
+		}
+	}
+	return nondefault
+}
+
+// FullConfigThreshold is the minimum number of options a Config must have
+// for LooksFull to consider it a full configuration. Even the smallest
+// configurations generated by the kernel build system, such as those
+// produced by make tinyconfig, have several hundred options, while typical
+// defconfig fragments have a few dozen.
+var FullConfigThreshold = 500
+
+// fullConfigMarkers are options which are written to every full
+// configuration, but which are omitted from fragments produced by make
+// savedefconfig unless they are set to a value other than their default.
+var fullConfigMarkers = []string{"MODULES", "PRINTK", "BLOCK"}
+
+// LooksFull returns a boolean indicating whether cfg looks like a full
+// configuration, as produced by make oldconfig and friends, as opposed to
+// a minimal fragment, such as a defconfig. It is a heuristic: cfg looks
+// full if it has at least FullConfigThreshold options, and if MODULES,
+// PRINTK and BLOCK are all present, with any value, including n. Large
+// defconfig fragments are distinguished from full configurations by the
+// latter condition, since PRINTK and BLOCK are enabled by default, and are
+// thus usually absent from fragments.
+func (cfg Config) LooksFull() bool {
+	if len(cfg) < FullConfigThreshold {
+		return false
+	}
+	for _, opt := range fullConfigMarkers {
+		if _, ok := cfg[opt]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// StringValue returns the unquoted value of the string option opt. The
+// boolean ok reports whether opt is present in cfg, and its value is a
+// valid quoted string. For example, if cfg holds the value `"a \"b\" c"`,
+// StringValue returns `a "b" c`.
+func (cfg Config) StringValue(opt string) (s string, ok bool) {
+	val, ok := cfg[opt]
+	if !ok {
+		return "", false
+	}
+	s, err := UnquoteValue(val)
+	if err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// StringList interprets the value of the specified option as a string, and
+// splits it into whitespace-separated tokens. For example, given
+// CONFIG_CMDLINE="console=ttyS0 quiet", it returns the tokens
+// "console=ttyS0" and "quiet". If the option is not present in cfg, or if
+// its value is not a quoted string (e.g. it is a tristate or a number),
+// StringList returns ok == false.
+func (cfg Config) StringList(opt string) (tokens []string, ok bool) {
+	val, ok := cfg[opt]
+	if !ok {
+		return nil, false
+	}
+	s, err := UnquoteValue(val)
+	if err != nil {
+		return nil, false
+	}
+	return strings.Fields(s), true
+}
+
+// LocalVersion returns the unquoted value of the LOCALVERSION option, i.e.
+// the string appended to the kernel release. If the option is not set,
+// or if its value is not a valid string, LocalVersion returns the empty
+// string.
+func (cfg Config) LocalVersion() string {
+	val, ok := cfg["LOCALVERSION"]
+	if !ok {
+		return ""
+	}
+	s, err := UnquoteValue(val)
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// LocalVersionAuto returns the value of the LOCALVERSION_AUTO option, which
+// controls whether version control information is appended to the kernel
+// release. The boolean ok reports whether the option is present in cfg.
+func (cfg Config) LocalVersionAuto() (enabled bool, ok bool) {
+	val, ok := cfg["LOCALVERSION_AUTO"]
+	if !ok {
+		return false, false
+	}
+	return val == "y", true
+}
+
+// QuoteValue quotes s as a string value in a kernel configuration file:
+// it encloses s in double quotes, and escapes double quotes and backslashes
+// using a backslash. It is the inverse of UnquoteValue. For example,
+// QuoteValue(`a "b"`) returns `"a \"b\""`, which can be stored in a Config.
+func QuoteValue(s string) string {
+	sb := new(strings.Builder)
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// UnquoteValue interprets val as a string value in a kernel configuration
+// file, i.e. a value enclosed in double quotes, in which double quotes and
+// backslashes are escaped using a backslash, and returns the string it
+// denotes. It returns an error if val is not a well-formed string value.
+func UnquoteValue(val string) (string, error) {
+	if len(val) < 2 || val[0] != '"' || val[len(val)-1] != '"' {
+		return "", xerrors.Errorf("linuxkernel: %q is not a quoted string", val)
+	}
+	val = val[1 : len(val)-1]
+	sb := new(strings.Builder)
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		if c == '\\' {
+			i++
+			if i == len(val) {
+				return "", xerrors.Errorf("linuxkernel: trailing backslash in %q", val)
+			}
+			c = val[i]
+		} else if c == '"' {
+			return "", xerrors.Errorf("linuxkernel: unescaped quote in %q", val)
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), nil
+}
+
+// GroupByPrefix groups the options in cfg by their prefix, i.e. the part of
+// the option name preceding the first occurrence of sep. For example, if sep
+// is "_", then NET_IPV4 and NET_IPV6 are grouped under "NET". Options which
+// do not contain sep are grouped under their full name.
+//
+// The Config values in the returned map contain the full option names, so
+// they are themselves valid configurations.
+func (cfg Config) GroupByPrefix(sep string) map[string]Config {
+	groups := make(map[string]Config)
+	for opt, val := range cfg {
+		prefix := optionPrefix(opt, sep)
+		group, ok := groups[prefix]
+		if !ok {
+			group = make(Config)
+			groups[prefix] = group
+		}
+		group[opt] = val
+	}
+	return groups
+}
+
+// optionPrefix returns the part of opt preceding the first occurrence of
+// sep, or opt itself if sep is empty or opt does not contain sep.
+func optionPrefix(opt, sep string) string {
+	if sep == "" {
+		return opt
+	}
+	if idx := strings.Index(opt, sep); idx >= 0 {
+		return opt[:idx]
+	}
+	return opt
+}
+
+// WriteTree writes cfg to w as an indented tree, in which options are
+// grouped by successive segments of their names, separated by sep. Each
+// line holds a segment, followed by the value of the option of that name,
+// if there is one. Segments are indented by two spaces per level, and
+// sorted at each level. To keep the tree shallow, a segment which has no
+// value and only one child is merged with the child. For example, given
+// NET=y, NET_IPV4=y, NET_IPV6=m and EXT4_FS=m, and sep "_", WriteTree
+// writes:
+//
+//	EXT4_FS m
+//	NET y
+//	  IPV4 y
+//	  IPV6 m
+//
+// If sep is empty, the tree is flat.
+func (cfg Config) WriteTree(w io.Writer, sep string) (int64, error) {
+	root := &configTree{}
+	for opt, val := range cfg {
+		root.insert(splitOption(opt, sep), val)
+	}
+	cfgw := &configWriter{W: w}
+	root.write(cfgw, sep, -1)
+	return cfgw.N, cfgw.Err
+}
+
+// splitOption splits opt into segments separated by sep. If sep is empty,
+// opt is a single segment.
+func splitOption(opt, sep string) []string {
+	if sep == "" {
+		return []string{opt}
+	}
+	return strings.Split(opt, sep)
+}
+
+// configTree is a node in the tree written by Config.WriteTree.
+type configTree struct {
+	Val      string
+	HasVal   bool
+	Children map[string]*configTree
+}
+
+func (node *configTree) insert(segments []string, val string) {
+	for _, seg := range segments {
+		if node.Children == nil {
+			node.Children = make(map[string]*configTree)
+		}
+		child, ok := node.Children[seg]
+		if !ok {
+			child = &configTree{}
+			node.Children[seg] = child
+		}
+		node = child
+	}
+	node.Val = val
+	node.HasVal = true
+}
+
+// write writes the children of node at the specified depth.
+func (node *configTree) write(cfgw *configWriter, sep string, depth int) {
+	labels := make([]string, 0, len(node.Children))
+	for label := range node.Children {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		child := node.Children[label]
+		for !child.HasVal && len(child.Children) == 1 {
+			for next, grandchild := range child.Children {
+				label += sep + next
+				child = grandchild
+			}
+		}
+		cfgw.WriteTreeLine(depth+1, label, child.Val, child.HasVal)
+		child.write(cfgw, sep, depth+1)
+	}
+}
+
+// Rename returns a copy of cfg in which each option which is a key in
+// renames is renamed to the corresponding value, preserving its value.
+// Renames are applied simultaneously, so chains and swaps behave as
+// expected.
+//
+// If the new name of an option is already taken in the result, e.g. because
+// cfg sets both the old and the new name, the existing value wins, and the
+// renamed option is dropped. The names of the dropped options are returned,
+// sorted. If several options are renamed to the same name, and the name is
+// not otherwise taken, the option which sorts first wins.
+func (cfg Config) Rename(renames map[string]string) (Config, []string) {
+	renamed := make(Config, len(cfg))
+	var pending []string
+	for opt, val := range cfg {
+		if _, ok := renames[opt]; ok {
+			pending = append(pending, opt)
+		} else {
+			renamed[opt] = val
+		}
+	}
+	sort.Strings(pending)
+	var collisions []string
+	for _, opt := range pending {
+		target := renames[opt]
+		if _, ok := renamed[target]; ok {
+			collisions = append(collisions, opt)
+			continue
+		}
+		renamed[target] = cfg[opt]
+	}
+	return renamed, collisions
+}
+
+// Removed is a sentinel value. When used as the value of a ConfigValue
+// passed to Apply, it causes the option to be removed from the
+// configuration.
+const Removed = "\x00removed"
+
+// Apply returns a copy of cfg in which the options specified by changes are
+// set to their corresponding values, or removed, if the value is Removed.
+// Changes are applied in order, so if an option appears more than once,
+// the last value wins. Unlike ApplyDiff, Apply overwrites values
+// unconditionally, and never fails.
+func (cfg Config) Apply(changes ...ConfigValue) Config {
+	new := cfg.clone()
+	for _, cv := range changes {
+		if cv.Val == Removed {
+			delete(new, cv.Opt)
+		} else {
+			new[cv.Opt] = cv.Val
+		}
+	}
+	return new
+}
+
+// SetAll returns a copy of cfg in which each of the specified options is set
+// to val. Options not present in cfg are added.
+func (cfg Config) SetAll(opts []string, val string) Config {
+	new := cfg.clone()
+	for _, opt := range opts {
+		new[opt] = val
+	}
+	return new
+}
+
+// A ConfigTransform transforms a configuration into another.
+type ConfigTransform func(Config) Config
+
+// Pipeline returns a ConfigTransform which applies the specified transforms
+// in order, from left to right. Each transform is passed a copy of the
+// output of the previous one, so transforms are free to modify their
+// input in place, and the configuration passed to the pipeline is never
+// modified. An empty pipeline returns a copy of its input.
+func Pipeline(transforms ...ConfigTransform) ConfigTransform {
+	return func(cfg Config) Config {
+		for _, transform := range transforms {
+			cfg = transform(cfg.clone())
+		}
+		return cfg.clone()
+	}
+}
+
+// clone returns a copy of cfg.
+func (cfg Config) clone() Config {
 	new := make(Config, len(cfg))
 	for opt, val := range cfg {
 		new[opt] = val
 	}
+	return new
+}
+
+// ApplyDiff applies the specified diff to cfg and returns a new config, such
+// that, schematically, if x.ApplyDiff(d) == y, then DiffConfig(x, y) == d.
+func (cfg Config) ApplyDiff(diff ConfigDiff) (Config, error) {
+	new := cfg.clone()
 	for _, cv := range diff.InOld {
 		if _, ok := cfg[cv.Opt]; !ok {
 			return nil, invalidOldValueError(cv)
 		}
 		delete(new, cv.Opt)
 	}
-	for _, cc := range diff.Changes {
-		oldval, ok := cfg[cc.Opt]
-		if !ok {
-			return nil, invalidChangeError(cc)
-		}
-		if oldval != cc.OldVal {
-			return nil, mismatchedChangeError{cc: cc, oldval: oldval}
-		}
-		new[cc.Opt] = cc.NewVal
+	for _, cc := range diff.Changes {
+		oldval, ok := cfg[cc.Opt]
+		if !ok {
+			return nil, invalidChangeError(cc)
+		}
+		if oldval != cc.OldVal {
+			return nil, mismatchedChangeError{cc: cc, oldval: oldval}
+		}
+		new[cc.Opt] = cc.NewVal
+	}
+	for _, cv := range diff.InNew {
+		if _, ok := cfg[cv.Opt]; ok {
+			return nil, invalidNewValueError(cv)
+		}
+		new[cv.Opt] = cv.Val
+	}
+	return new, nil
+}
+
+// ApplyDiffBestEffort is like ApplyDiff, but rather than failing if an entry
+// in the diff cannot be applied to cfg, it skips the entry, and carries on
+// with the rest. The skipped entries are returned, in the order in which
+// they appear in the diff, as the option and the value which the diff would
+// have set it to.
+//
+// An entry in Changes is skipped if the option is missing from cfg, or has
+// a value other than the old value. An entry in InNew is skipped if the
+// option is already present in cfg, with a different value. Entries whose
+// effect already holds in cfg are not considered skipped, so options in
+// InOld are removed if present, and never skipped.
+func (cfg Config) ApplyDiffBestEffort(diff ConfigDiff) (Config, []ConfigValue) {
+	new := cfg.clone()
+	var skipped []ConfigValue
+	for _, cv := range diff.InOld {
+		delete(new, cv.Opt)
+	}
+	for _, cc := range diff.Changes {
+		oldval, ok := cfg[cc.Opt]
+		switch {
+		case ok && oldval == cc.OldVal:
+			new[cc.Opt] = cc.NewVal
+		case ok && oldval == cc.NewVal:
+			// Already applied.
+		default:
+			skipped = append(skipped, ConfigValue{Opt: cc.Opt, Val: cc.NewVal})
+		}
+	}
+	for _, cv := range diff.InNew {
+		oldval, ok := cfg[cv.Opt]
+		switch {
+		case !ok:
+			new[cv.Opt] = cv.Val
+		case oldval == cv.Val:
+			// Already applied.
+		default:
+			skipped = append(skipped, cv)
+		}
+	}
+	return new, skipped
+}
+
+// ApplyDiffToFile parses the configuration file at path, applies the diff
+// to it, as ApplyDiff does, and writes the result back to path, as WriteTo
+// does. The file is replaced atomically: the new contents are written to
+// a temporary file in the same directory, which is then renamed over the
+// original. If any step fails, the original file is left untouched.
+func ApplyDiffToFile(path string, diff ConfigDiff) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseConfigFile(path)
+	if err != nil {
+		return xerrors.Errorf("linuxkernel: failed to load %s: %w", path, err)
+	}
+	applied, err := cfg.ApplyDiff(diff)
+	if err != nil {
+		return xerrors.Errorf("linuxkernel: failed to apply diff to %s: %w", path, err)
+	}
+
+	dir, base := filepath.Split(path)
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := writeConfigFile(tmp, applied, fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// writeConfigFile writes cfg to f, sets its permissions to perm, flushes
+// it to stable storage, and closes it.
+func writeConfigFile(f *os.File, cfg Config, perm os.FileMode) error {
+	if _, err := cfg.WriteTo(f); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
 	}
-	for _, cv := range diff.InNew {
-		if _, ok := cfg[cv.Opt]; ok {
-			return nil, invalidNewValueError(cv)
-		}
-		new[cv.Opt] = cv.Val
+	if err := f.Sync(); err != nil {
+		return err
 	}
-	return new, nil
+	return f.Close()
 }
 
 // DiffConfig returns the differences between the old and new config.
 func DiffConfig(old, new Config) ConfigDiff {
+	return diffConfig(old, new, nil)
+}
+
+// DiffConfigIgnoringValues is like DiffConfig, but for options for which
+// ignore returns true, it never reports a change in value. Such options are
+// still reported in the InOld and InNew slices, if they are present in only
+// one of the configurations.
+func DiffConfigIgnoringValues(old, new Config, ignore func(opt string) bool) ConfigDiff {
+	return diffConfig(old, new, ignore)
+}
+
+// diffConfig implements DiffConfig and DiffConfigIgnoringValues. If ignore
+// is nil, all changes in value are reported.
+func diffConfig(old, new Config, ignore func(opt string) bool) ConfigDiff {
 	diff := ConfigDiff{}
 	for opt, oldval := range old {
 		newval, ok := new[opt]
@@ -157,7 +1272,7 @@ func DiffConfig(old, new Config) ConfigDiff {
 				Opt: opt,
 				Val: oldval,
 			})
-		} else if oldval != newval {
+		} else if oldval != newval && (ignore == nil || !ignore(opt)) {
 			diff.Changes = append(diff.Changes, ConfigChange{
 				Opt:    opt,
 				OldVal: oldval,
@@ -177,8 +1292,124 @@ func DiffConfig(old, new Config) ConfigDiff {
 	return diff
 }
 
+// StreamDiff computes the differences between the old and new config and
+// writes them to w, producing the same output as DiffConfig(old, new).WriteTo
+// would. Unlike DiffConfig, it does not materialize the diff: it sorts the
+// option names of both configs, and merge-walks the two sorted lists,
+// writing each difference as soon as it is found. Since the output is
+// grouped as InOld, Changes, InNew, the lists are walked once per group.
+// Memory use is that of the two lists of names, regardless of the size of
+// the diff.
+func StreamDiff(old, new Config, w io.Writer) (int64, error) {
+	oldopts := old.sortedOptions()
+	newopts := new.sortedOptions()
+	cfgdw := &configDiffWriter{W: w}
+	mergeOptions(oldopts, newopts, func(opt string, inold, innew bool) {
+		if inold && !innew {
+			cfgdw.WriteOld(ConfigValue{Opt: opt, Val: old[opt]})
+		}
+	})
+	mergeOptions(oldopts, newopts, func(opt string, inold, innew bool) {
+		if inold && innew && old[opt] != new[opt] {
+			cfgdw.WriteChange(ConfigChange{Opt: opt, OldVal: old[opt], NewVal: new[opt]})
+		}
+	})
+	mergeOptions(oldopts, newopts, func(opt string, inold, innew bool) {
+		if !inold && innew {
+			cfgdw.WriteNew(ConfigValue{Opt: opt, Val: new[opt]})
+		}
+	})
+	return cfgdw.N, cfgdw.Err
+}
+
+// mergeOptions walks the sorted option lists a and b in order, and calls fn
+// for each distinct option, reporting which of the lists it appears in.
+func mergeOptions(a, b []string, fn func(opt string, ina, inb bool)) {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || i < len(a) && a[i] < b[j]:
+			fn(a[i], true, false)
+			i++
+		case i == len(a) || b[j] < a[i]:
+			fn(b[j], false, true)
+			j++
+		default:
+			fn(a[i], true, true)
+			i++
+			j++
+		}
+	}
+}
+
+// ConfigIntersection returns the options which are present in both old and
+// new, with the same value. It is the complement of DiffConfig: the part of
+// the two configurations which DiffConfig does not report on.
+func ConfigIntersection(old, new Config) Config {
+	common := make(Config)
+	for opt, oldval := range old {
+		if newval, ok := new[opt]; ok && oldval == newval {
+			common[opt] = oldval
+		}
+	}
+	return common
+}
+
+// UniqueOptions maps the name of each configuration in configs to the
+// sorted list of options which are present in that configuration, but in
+// none of the others. Values are not compared: an option is unique to a
+// configuration only if the other configurations do not mention it at all.
+// Configurations with no unique options map to a nil slice.
+func UniqueOptions(configs map[string]Config) map[string][]string {
+	count := make(map[string]int)
+	for _, cfg := range configs {
+		for opt := range cfg {
+			count[opt]++
+		}
+	}
+	unique := make(map[string][]string, len(configs))
+	for name, cfg := range configs {
+		var opts []string
+		for opt := range cfg {
+			if count[opt] == 1 {
+				opts = append(opts, opt)
+			}
+		}
+		sort.Strings(opts)
+		unique[name] = opts
+	}
+	return unique
+}
+
+// MinimalEnableDiff returns the smallest diff which, when applied to base,
+// makes each option in want hold the corresponding value. Options in base
+// which are not mentioned in want are left alone, so the returned diff never
+// has any InOld entries.
+func MinimalEnableDiff(base Config, want map[string]string) ConfigDiff {
+	diff := ConfigDiff{}
+	for opt, wantval := range want {
+		baseval, ok := base[opt]
+		if !ok {
+			diff.InNew = append(diff.InNew, ConfigValue{
+				Opt: opt,
+				Val: wantval,
+			})
+		} else if baseval != wantval {
+			diff.Changes = append(diff.Changes, ConfigChange{
+				Opt:    opt,
+				OldVal: baseval,
+				NewVal: wantval,
+			})
+		}
+	}
+	diff.sort()
+	return diff
+}
+
 // ConfigDiff contains differences between two kernel configurations. The
-// slices are sorted by the option name.
+// slices are sorted by the option name. Ties, which DiffConfig never
+// produces, but which may occur in diffs constructed by hand, are broken by
+// value: by Val in InOld and InNew, and by OldVal, then NewVal in Changes.
 type ConfigDiff struct {
 	InOld   []ConfigValue
 	Changes []ConfigChange
@@ -186,14 +1417,14 @@ type ConfigDiff struct {
 }
 
 func (diff ConfigDiff) sort() {
-	sort.Slice(diff.InOld, func(i, j int) bool {
-		return diff.InOld[i].Opt < diff.InOld[j].Opt
+	sort.SliceStable(diff.InOld, func(i, j int) bool {
+		return diff.InOld[i].less(diff.InOld[j])
 	})
-	sort.Slice(diff.Changes, func(i, j int) bool {
-		return diff.Changes[i].Opt < diff.Changes[j].Opt
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		return diff.Changes[i].less(diff.Changes[j])
 	})
-	sort.Slice(diff.InNew, func(i, j int) bool {
-		return diff.InNew[i].Opt < diff.InNew[j].Opt
+	sort.SliceStable(diff.InNew, func(i, j int) bool {
+		return diff.InNew[i].less(diff.InNew[j])
 	})
 }
 
@@ -215,6 +1446,433 @@ func (diff ConfigDiff) WriteTo(w io.Writer) (int64, error) {
 	return cfgdw.N, cfgdw.Err
 }
 
+// WriteChangesOnly is like WriteTo, but it only writes the Changes, i.e.
+// the options whose value changed, omitting options which were added or
+// removed. The changes are written sorted by option name.
+func (diff ConfigDiff) WriteChangesOnly(w io.Writer) (int64, error) {
+	changes := append([]ConfigChange(nil), diff.Changes...)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].less(changes[j])
+	})
+	cfgdw := &configDiffWriter{W: w}
+	for _, cc := range changes {
+		cfgdw.WriteChange(cc)
+	}
+	return cfgdw.N, cfgdw.Err
+}
+
+// WriteColored writes the diff to w in the same order as WriteTo, but pads
+// option names to a common width, such that the values line up. If color
+// is true, lines are colored using ANSI escape sequences: red for InOld,
+// yellow for Changes, and green for InNew.
+func (diff ConfigDiff) WriteColored(w io.Writer, color bool) (int64, error) {
+	cfgdw := &configDiffWriter{
+		W:     w,
+		Width: diff.optionWidth(),
+		Color: color,
+	}
+	for _, cv := range diff.InOld {
+		cfgdw.WriteOld(cv)
+	}
+	for _, cc := range diff.Changes {
+		cfgdw.WriteChange(cc)
+	}
+	for _, cv := range diff.InNew {
+		cfgdw.WriteNew(cv)
+	}
+	return cfgdw.N, cfgdw.Err
+}
+
+// WriteGrouped writes the diff to w, grouping entries by the prefix of
+// their option name, as computed by Config.GroupByPrefix. Each group is
+// introduced by a "# PREFIX" header line, and groups are separated by blank
+// lines. Groups are written in sorted order. Within a group, entries are
+// written in the same order and format as WriteTo.
+func (diff ConfigDiff) WriteGrouped(w io.Writer, sep string) (int64, error) {
+	groups := make(map[string]*ConfigDiff)
+	group := func(opt string) *ConfigDiff {
+		prefix := optionPrefix(opt, sep)
+		g, ok := groups[prefix]
+		if !ok {
+			g = new(ConfigDiff)
+			groups[prefix] = g
+		}
+		return g
+	}
+	for _, cv := range diff.InOld {
+		g := group(cv.Opt)
+		g.InOld = append(g.InOld, cv)
+	}
+	for _, cc := range diff.Changes {
+		g := group(cc.Opt)
+		g.Changes = append(g.Changes, cc)
+	}
+	for _, cv := range diff.InNew {
+		g := group(cv.Opt)
+		g.InNew = append(g.InNew, cv)
+	}
+
+	prefixes := make([]string, 0, len(groups))
+	for prefix := range groups {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	cfgdw := &configDiffWriter{W: w}
+	for i, prefix := range prefixes {
+		if i > 0 {
+			cfgdw.printf("", "")
+		}
+		cfgdw.printf("", "# %s", prefix)
+		g := groups[prefix]
+		for _, cv := range g.InOld {
+			cfgdw.WriteOld(cv)
+		}
+		for _, cc := range g.Changes {
+			cfgdw.WriteChange(cc)
+		}
+		for _, cv := range g.InNew {
+			cfgdw.WriteNew(cv)
+		}
+	}
+	return cfgdw.N, cfgdw.Err
+}
+
+// optionWidth returns the length of the longest option name in the diff.
+func (diff ConfigDiff) optionWidth() int {
+	width := 0
+	for _, cv := range diff.InOld {
+		if len(cv.Opt) > width {
+			width = len(cv.Opt)
+		}
+	}
+	for _, cc := range diff.Changes {
+		if len(cc.Opt) > width {
+			width = len(cc.Opt)
+		}
+	}
+	for _, cv := range diff.InNew {
+		if len(cv.Opt) > width {
+			width = len(cv.Opt)
+		}
+	}
+	return width
+}
+
+// DiffStats summarizes a ConfigDiff.
+type DiffStats struct {
+	InOld      int // number of options only in the old config
+	Changes    int // number of options whose value changed
+	InNew      int // number of options only in the new config
+	Promotions int // number of tristate upgrades, see ConfigDiff.Promotions
+	Demotions  int // number of tristate downgrades, see ConfigDiff.Demotions
+}
+
+// Stats computes summary statistics for the diff.
+func (diff ConfigDiff) Stats() DiffStats {
+	return DiffStats{
+		InOld:      len(diff.InOld),
+		Changes:    len(diff.Changes),
+		InNew:      len(diff.InNew),
+		Promotions: len(diff.Promotions()),
+		Demotions:  len(diff.Demotions()),
+	}
+}
+
+// TouchedOptions returns the sorted names of all options mentioned by the
+// diff, whether removed, changed or added. Each option is listed once, even
+// if it appears in more than one part of the diff.
+func (diff ConfigDiff) TouchedOptions() []string {
+	seen := make(map[string]bool)
+	var opts []string
+	add := func(opt string) {
+		if !seen[opt] {
+			seen[opt] = true
+			opts = append(opts, opt)
+		}
+	}
+	for _, cv := range diff.InOld {
+		add(cv.Opt)
+	}
+	for _, cc := range diff.Changes {
+		add(cc.Opt)
+	}
+	for _, cv := range diff.InNew {
+		add(cv.Opt)
+	}
+	sort.Strings(opts)
+	return opts
+}
+
+// Split splits the diff into an additive and a subtractive half. The
+// additive half contains the InNew entries, and the Changes which upgrade
+// a tristate option, or which change a value other than a tristate. The
+// subtractive half contains the InOld entries, and the Changes which
+// downgrade a tristate option. The halves touch disjoint sets of options,
+// so applying them in sequence, in either order, is equivalent to applying
+// the whole diff.
+func (diff ConfigDiff) Split() (additive, subtractive ConfigDiff) {
+	additive.InNew = append(additive.InNew, diff.InNew...)
+	subtractive.InOld = append(subtractive.InOld, diff.InOld...)
+	for _, cc := range diff.Changes {
+		old, oldok := cc.OldTristate()
+		new, newok := cc.NewTristate()
+		if oldok && newok && new < old {
+			subtractive.Changes = append(subtractive.Changes, cc)
+		} else {
+			additive.Changes = append(additive.Changes, cc)
+		}
+	}
+	return additive, subtractive
+}
+
+// Normalize returns a copy of the diff without the InOld and InNew entries
+// whose value is n. Under normalized semantics, an option which is not set
+// is equivalent to an option which is absent, so such entries do not
+// represent a meaningful difference: for example, they arise when one of
+// the configurations contains "# CONFIG_X is not set", and the other does
+// not mention X at all. Changes are kept as they are.
+func (diff ConfigDiff) Normalize() ConfigDiff {
+	var normalized ConfigDiff
+	for _, cv := range diff.InOld {
+		if cv.Val != "n" {
+			normalized.InOld = append(normalized.InOld, cv)
+		}
+	}
+	normalized.Changes = append(normalized.Changes, diff.Changes...)
+	for _, cv := range diff.InNew {
+		if cv.Val != "n" {
+			normalized.InNew = append(normalized.InNew, cv)
+		}
+	}
+	return normalized
+}
+
+// Preconditions returns the values a configuration must have for the diff
+// to apply to it, sorted by option: options in InOld must be present with
+// their old values, and options in Changes must have their old values.
+// In addition, ApplyDiff requires the options in InNew to be absent; these
+// are not included in the result, since they have no value to report.
+//
+// ApplyDiff itself only checks that options in InOld are present, and does
+// not compare their values, so Preconditions is somewhat stricter. It
+// describes the configuration the diff was computed against.
+func (diff ConfigDiff) Preconditions() []ConfigValue {
+	pre := make([]ConfigValue, 0, len(diff.InOld)+len(diff.Changes))
+	pre = append(pre, diff.InOld...)
+	for _, cc := range diff.Changes {
+		pre = append(pre, ConfigValue{Opt: cc.Opt, Val: cc.OldVal})
+	}
+	sort.SliceStable(pre, func(i, j int) bool {
+		return pre[i].Opt < pre[j].Opt
+	})
+	return pre
+}
+
+// DiffAgainst computes the differences between the specified baseline and
+// cfg, as DiffConfig(baseline, cfg) does, and summarizes them.
+func (cfg Config) DiffAgainst(baseline Config) (ConfigDiff, DiffStats) {
+	diff := DiffConfig(baseline, cfg)
+	return diff, diff.Stats()
+}
+
+// DiffTo returns the differences between cfg and target, as
+// DiffConfig(cfg, target) does, i.e. the diff which transforms cfg
+// into target.
+func (cfg Config) DiffTo(target Config) ConfigDiff {
+	return DiffConfig(cfg, target)
+}
+
+// WriteChangelog parses the configuration file at baselinePath, computes
+// the differences between it and cfg, as DiffConfig(baseline, cfg) does,
+// and writes them to w, in the format of ConfigDiff.WriteTo.
+func (cfg Config) WriteChangelog(w io.Writer, baselinePath string) error {
+	baseline, err := parseConfigFile(baselinePath)
+	if err != nil {
+		return xerrors.Errorf("linuxkernel: failed to load baseline %s: %w", baselinePath, err)
+	}
+	_, err = DiffConfig(baseline, cfg).WriteTo(w)
+	return err
+}
+
+// Promotions returns the changes in the diff which upgrade a tristate option:
+// n to m, n to y, or m to y.
+func (diff ConfigDiff) Promotions() []ConfigChange {
+	return diff.tristateChanges(func(old, new Tristate) bool {
+		return new > old
+	})
+}
+
+// Demotions returns the changes in the diff which downgrade a tristate
+// option: y to m, y to n, or m to n.
+func (diff ConfigDiff) Demotions() []ConfigChange {
+	return diff.tristateChanges(func(old, new Tristate) bool {
+		return new < old
+	})
+}
+
+// tristateChanges returns the changes in the diff for which both the old
+// and the new values are tristates, and for which pred returns true.
+func (diff ConfigDiff) tristateChanges(pred func(old, new Tristate) bool) []ConfigChange {
+	var changes []ConfigChange
+	for _, cc := range diff.Changes {
+		old, ok := cc.OldTristate()
+		if !ok {
+			continue
+		}
+		new, ok := cc.NewTristate()
+		if !ok {
+			continue
+		}
+		if pred(old, new) {
+			changes = append(changes, cc)
+		}
+	}
+	return changes
+}
+
+// ChangeClass is a coarse description of the effect of a change to an option.
+type ChangeClass int
+
+// Change classes.
+const (
+	FeatureEnabled  ChangeClass = iota // a feature was turned on
+	FeatureDisabled                    // a feature was turned off, or removed
+	ModulePromoted                     // m to y
+	ModuleDemoted                      // y to m
+	TunableChanged                     // a numeric or other value changed
+	StringChanged                      // a string value changed
+)
+
+// String returns the name of the change class, e.g. "FeatureEnabled".
+func (class ChangeClass) String() string {
+	switch class {
+	case FeatureEnabled:
+		return "FeatureEnabled"
+	case FeatureDisabled:
+		return "FeatureDisabled"
+	case ModulePromoted:
+		return "ModulePromoted"
+	case ModuleDemoted:
+		return "ModuleDemoted"
+	case TunableChanged:
+		return "TunableChanged"
+	case StringChanged:
+		return "StringChanged"
+	default:
+		return fmt.Sprintf("ChangeClass(%d)", int(class))
+	}
+}
+
+// Classify labels each option mentioned by the diff with a ChangeClass,
+// according to the transition of its value. The classification is
+// heuristic, and is meant for producing categorized summaries of diffs:
+//
+// Tristate options going from n to m or y, or added as m or y, are
+// FeatureEnabled. Tristate options going from m or y to n, removed, or added
+// as n are FeatureDisabled. Tristate options going from m to y are
+// ModulePromoted, and from y to m, ModuleDemoted. Any other change, addition
+// or removal is StringChanged if either value is a quoted string, and
+// TunableChanged otherwise.
+func (diff ConfigDiff) Classify() map[string]ChangeClass {
+	classes := make(map[string]ChangeClass)
+	for _, cv := range diff.InOld {
+		if _, ok := cv.Tristate(); ok {
+			classes[cv.Opt] = FeatureDisabled
+		} else {
+			classes[cv.Opt] = classifyValueChange(cv.Val, "")
+		}
+	}
+	for _, cc := range diff.Changes {
+		classes[cc.Opt] = classifyChange(cc)
+	}
+	for _, cv := range diff.InNew {
+		if t, ok := cv.Tristate(); ok {
+			if t == TristateNo {
+				classes[cv.Opt] = FeatureDisabled
+			} else {
+				classes[cv.Opt] = FeatureEnabled
+			}
+		} else {
+			classes[cv.Opt] = classifyValueChange("", cv.Val)
+		}
+	}
+	return classes
+}
+
+// classifyChange implements Classify for a single change.
+func classifyChange(cc ConfigChange) ChangeClass {
+	old, oldok := cc.OldTristate()
+	new, newok := cc.NewTristate()
+	if !oldok || !newok {
+		return classifyValueChange(cc.OldVal, cc.NewVal)
+	}
+	switch {
+	case old == TristateNo:
+		return FeatureEnabled
+	case new == TristateNo:
+		return FeatureDisabled
+	case new > old:
+		return ModulePromoted
+	default:
+		return ModuleDemoted
+	}
+}
+
+// classifyValueChange classifies a change between non-tristate values.
+func classifyValueChange(oldval, newval string) ChangeClass {
+	if isQuoted(oldval) || isQuoted(newval) {
+		return StringChanged
+	}
+	return TunableChanged
+}
+
+// isQuoted returns true if val is enclosed in double quotes.
+func isQuoted(val string) bool {
+	return len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"'
+}
+
+// Tristate is the value of a tristate option. Tristates are ordered:
+// TristateNo < TristateModule < TristateYes.
+type Tristate int
+
+// Tristate values.
+const (
+	TristateNo     Tristate = iota // n
+	TristateModule                 // m
+	TristateYes                    // y
+)
+
+// ParseTristate parses a tristate value. The boolean ok reports whether val
+// is one of "n", "m" or "y".
+func ParseTristate(val string) (t Tristate, ok bool) {
+	switch val {
+	case "n":
+		return TristateNo, true
+	case "m":
+		return TristateModule, true
+	case "y":
+		return TristateYes, true
+	default:
+		return 0, false
+	}
+}
+
+// String returns the configuration file representation of t: "n", "m"
+// or "y".
+func (t Tristate) String() string {
+	switch t {
+	case TristateNo:
+		return "n"
+	case TristateModule:
+		return "m"
+	case TristateYes:
+		return "y"
+	default:
+		return fmt.Sprintf("Tristate(%d)", int(t))
+	}
+}
+
 // ConfigValue contains an option, value pair.
 type ConfigValue struct {
 	Opt, Val string
@@ -225,20 +1883,58 @@ func (cv ConfigValue) String() string {
 	return fmt.Sprintf("%s %s", cv.Opt, cv.Val)
 }
 
+// less reports whether cv sorts before other in a ConfigDiff.
+func (cv ConfigValue) less(other ConfigValue) bool {
+	if cv.Opt != other.Opt {
+		return cv.Opt < other.Opt
+	}
+	return cv.Val < other.Val
+}
+
+// Tristate interprets the value as a tristate. The boolean ok reports
+// whether the value is a valid tristate.
+func (cv ConfigValue) Tristate() (t Tristate, ok bool) {
+	return ParseTristate(cv.Val)
+}
+
 // ConfigChange specifies a change in a configuration value.
 type ConfigChange struct {
 	Opt, OldVal, NewVal string
 }
 
+// less reports whether cc sorts before other in a ConfigDiff.
+func (cc ConfigChange) less(other ConfigChange) bool {
+	if cc.Opt != other.Opt {
+		return cc.Opt < other.Opt
+	}
+	if cc.OldVal != other.OldVal {
+		return cc.OldVal < other.OldVal
+	}
+	return cc.NewVal < other.NewVal
+}
+
+// OldTristate interprets the old value as a tristate. The boolean ok
+// reports whether the old value is a valid tristate.
+func (cc ConfigChange) OldTristate() (t Tristate, ok bool) {
+	return ParseTristate(cc.OldVal)
+}
+
+// NewTristate interprets the new value as a tristate. The boolean ok
+// reports whether the new value is a valid tristate.
+func (cc ConfigChange) NewTristate() (t Tristate, ok bool) {
+	return ParseTristate(cc.NewVal)
+}
+
 // String formats cc as, for example: "INET6_ESP_OFFLOAD n -> m".
 func (cc ConfigChange) String() string {
 	return fmt.Sprintf("%s %s -> %s", cc.Opt, cc.OldVal, cc.NewVal)
 }
 
 type configWriter struct {
-	W   io.Writer
-	N   int64
-	Err error // sticky
+	W        io.Writer
+	N        int64
+	Err      error // sticky
+	Explicit bool  // write disabled options as CONFIG_X=n
 }
 
 func (cfgw *configWriter) WriteLine(option, value string) {
@@ -246,8 +1942,8 @@ func (cfgw *configWriter) WriteLine(option, value string) {
 		return
 	}
 	var n int
-	switch value {
-	case "n":
+	switch {
+	case value == "n" && !cfgw.Explicit:
 		n, cfgw.Err = fmt.Fprintf(cfgw.W, "# CONFIG_%s is not set\n", option)
 	default:
 		n, cfgw.Err = fmt.Fprintf(cfgw.W, "CONFIG_%s=%s\n", option, value)
@@ -255,36 +1951,67 @@ func (cfgw *configWriter) WriteLine(option, value string) {
 	cfgw.N += int64(n)
 }
 
-type configDiffWriter struct {
-	W   io.Writer
-	N   int64
-	Err error // sticky
-}
-
-func (cfgdw *configDiffWriter) WriteOld(cv ConfigValue) {
-	if cfgdw.Err != nil {
+func (cfgw *configWriter) WriteTreeLine(depth int, label, value string, hasValue bool) {
+	if cfgw.Err != nil {
 		return
 	}
 	var n int
-	n, cfgdw.Err = fmt.Fprintf(cfgdw.W, "-%s\n", cv)
-	cfgdw.N += int64(n)
+	indent := strings.Repeat("  ", depth)
+	if hasValue {
+		n, cfgw.Err = fmt.Fprintf(cfgw.W, "%s%s %s\n", indent, label, value)
+	} else {
+		n, cfgw.Err = fmt.Fprintf(cfgw.W, "%s%s\n", indent, label)
+	}
+	cfgw.N += int64(n)
 }
 
-func (cfgdw *configDiffWriter) WriteChange(cc ConfigChange) {
-	if cfgdw.Err != nil {
+func (cfgw *configWriter) WriteMakeLine(option, value string) {
+	if cfgw.Err != nil {
 		return
 	}
 	var n int
-	n, cfgdw.Err = fmt.Fprintf(cfgdw.W, " %s\n", cc)
-	cfgdw.N += int64(n)
+	n, cfgw.Err = fmt.Fprintf(cfgw.W, "CONFIG_%s := %s\n", option, value)
+	cfgw.N += int64(n)
+}
+
+type configDiffWriter struct {
+	W     io.Writer
+	N     int64
+	Err   error // sticky
+	Width int   // minimum width of option names
+	Color bool  // whether to use ANSI color escapes
+}
+
+// ANSI escape sequences used by configDiffWriter.
+const (
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+func (cfgdw *configDiffWriter) WriteOld(cv ConfigValue) {
+	cfgdw.printf(ansiRed, "-%-*s %s", cfgdw.Width, cv.Opt, cv.Val)
+}
+
+func (cfgdw *configDiffWriter) WriteChange(cc ConfigChange) {
+	cfgdw.printf(ansiYellow, " %-*s %s -> %s", cfgdw.Width, cc.Opt, cc.OldVal, cc.NewVal)
 }
 
 func (cfgdw *configDiffWriter) WriteNew(cv ConfigValue) {
+	cfgdw.printf(ansiGreen, "+%-*s %s", cfgdw.Width, cv.Opt, cv.Val)
+}
+
+func (cfgdw *configDiffWriter) printf(color string, format string, args ...interface{}) {
 	if cfgdw.Err != nil {
 		return
 	}
+	line := fmt.Sprintf(format, args...)
+	if cfgdw.Color {
+		line = color + line + ansiReset
+	}
 	var n int
-	n, cfgdw.Err = fmt.Fprintf(cfgdw.W, "+%s\n", cv)
+	n, cfgdw.Err = io.WriteString(cfgdw.W, line+"\n")
 	cfgdw.N += int64(n)
 }
 
@@ -318,3 +2045,18 @@ func (cv invalidNewValueError) Error() string {
 	return fmt.Sprintf("cannot apply diff: %q in diff.InNew, but %q in cfg",
 		ConfigValue(cv), cv.Opt)
 }
+
+type configsUnequalError struct {
+	Diff ConfigDiff
+}
+
+func (e configsUnequalError) Error() string {
+	sb := new(strings.Builder)
+	sb.WriteString("linuxkernel: configurations are not equal:\n")
+	e.Diff.WriteTo(sb)
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func (e configsUnequalError) Is(target error) bool {
+	return target == ErrConfigsUnequal
+}
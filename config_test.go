@@ -15,28 +15,1068 @@
 package linuxkernel
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+
+	"golang.org/x/xerrors"
 )
 
 func TestConfig(t *testing.T) {
 	t.Run("Parse", testConfigParse)
+	t.Run("ParseByteOrderMark", testConfigParseByteOrderMark)
+	t.Run("ParseNotSetSpacing", testConfigParseNotSetSpacing)
+	t.Run("ParseExtra", testConfigParseExtra)
 	t.Run("Equal", testConfigEqual)
+	t.Run("EqualNormalized", testConfigEqualNormalized)
+	t.Run("Canonicalize", testConfigCanonicalize)
+	t.Run("AssertEqual", testConfigAssertEqual)
 	t.Run("WriteTo", testConfigWriteTo)
 	t.Run("WriteToPredictableOrder", testConfigWriteToPredictableOrder)
+	t.Run("WriteToExplicit", testConfigWriteToExplicit)
+	t.Run("WriteMakefile", testConfigWriteMakefile)
+	t.Run("MarshalText", testConfigMarshalText)
 	t.Run("ApplyDiff", testApplyDiff)
+	t.Run("ApplyDiffBestEffort", testApplyDiffBestEffort)
+	t.Run("DiffAgainst", testConfigDiffAgainst)
+	t.Run("DiffTo", testConfigDiffTo)
+	t.Run("WriteChangelog", testConfigWriteChangelog)
+	t.Run("Apply", testConfigApply)
+	t.Run("SetAll", testConfigSetAll)
+	t.Run("Rename", testConfigRename)
+	t.Run("Search", testConfigSearch)
+	t.Run("ByValue", testConfigByValue)
+	t.Run("GroupByPrefix", testConfigGroupByPrefix)
+	t.Run("WriteTree", testConfigWriteTree)
+	t.Run("Get", testConfigGet)
+	t.Run("GetFold", testConfigGetFold)
+	t.Run("Forbid", testConfigForbid)
+	t.Run("Obsolete", testConfigObsolete)
+	t.Run("NonDefault", testConfigNonDefault)
+	t.Run("StringValue", testConfigStringValue)
+	t.Run("StringList", testConfigStringList)
+	t.Run("LocalVersion", testConfigLocalVersion)
+}
+
+func TestApplyDiffToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".config")
+	original := "# hand written\nCONFIG_B=m\nCONFIG_A=y\n"
+	if err := ioutil.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A diff which does not apply leaves the file untouched.
+	bad := ConfigDiff{Changes: []ConfigChange{{Opt: "A", OldVal: "n", NewVal: "m"}}}
+	if err := ApplyDiffToFile(path, bad); err == nil {
+		t.Fatal("ApplyDiffToFile succeeded with an inapplicable diff")
+	}
+	assertFileContents(t, path, original)
+
+	diff := ConfigDiff{
+		Changes: []ConfigChange{{Opt: "B", OldVal: "m", NewVal: "y"}},
+		InNew:   []ConfigValue{{Opt: "C", Val: "n"}},
+	}
+	if err := ApplyDiffToFile(path, diff); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContents(t, path, "CONFIG_A=y\nCONFIG_B=y\n# CONFIG_C is not set\n")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("permissions changed to %v, want 0600", perm)
+	}
+
+	// No temporary files are left behind.
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		var names []string
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("directory contains %q, want only .config", names)
+	}
+
+	if err := ApplyDiffToFile(filepath.Join(dir, "missing"), diff); err == nil {
+		t.Fatal("ApplyDiffToFile succeeded on a missing file")
+	}
+}
+
+func assertFileContents(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s contains %q, want %q", path, got, want)
+	}
+}
+
+func TestParseConfigs(t *testing.T) {
+	input := `# generated by CI
+
+### config: x86_64
+CONFIG_SMP=y
+CONFIG_X86_64=y
+  ### config:   arm64-debug  
+CONFIG_SMP=y
+# CONFIG_X86_64 is not set
+CONFIG_DEBUG_INFO=y
+### config: empty
+`
+	got, err := ParseConfigs(strings.NewReader(input), "### config:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Config{
+		"x86_64":      {"SMP": "y", "X86_64": "y"},
+		"arm64-debug": {"SMP": "y", "X86_64": "n", "DEBUG_INFO": "y"},
+		"empty":       {},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	bad := []string{
+		"CONFIG_SMP=y\n### config: a\n",
+		"### config: a\n### config: a\n",
+		"### config:\nCONFIG_SMP=y\n",
+	}
+	for _, input := range bad {
+		if _, err := ParseConfigs(strings.NewReader(input), "### config:"); err == nil {
+			t.Errorf("ParseConfigs(%q) succeeded", input)
+		}
+	}
+}
+
+func TestLoadConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.config")
+	local := filepath.Join(dir, "local.config")
+	if err := ioutil.WriteFile(base, []byte("CONFIG_A=y\nCONFIG_B=m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(local, []byte("CONFIG_B=y\n# CONFIG_C is not set\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LoadConfigs(base, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{"A": "y", "B": "y", "C": "n"}
+	if !got.Equal(want) {
+		t.Fatalf("LoadConfigs(%q, %q) = %#v, want %#v", base, local, got, want)
+	}
+
+	missing := filepath.Join(dir, "missing.config")
+	_, err = LoadConfigs(base, missing)
+	if err == nil {
+		t.Fatalf("LoadConfigs(%q, %q) succeeded", base, missing)
+	}
+	if !strings.Contains(err.Error(), missing) {
+		t.Fatalf("error %q does not mention %q", err, missing)
+	}
+	if !xerrors.Is(err, os.ErrNotExist) {
+		t.Fatalf("error %v does not wrap os.ErrNotExist", err)
+	}
+}
+
+func TestParseConfigWithIncludes(t *testing.T) {
+	fragments := map[string]string{
+		"top":     "CONFIG_A=y\n# include <net>\nCONFIG_B=y\n# include debug\n",
+		"net":     "CONFIG_NET=y\nCONFIG_B=m\n# include common\n",
+		"debug":   "CONFIG_DEBUG=y\nCONFIG_A=n\n#include common\n",
+		"common":  "CONFIG_COMMON=y\n",
+		"cycle1":  "CONFIG_X=y\n# include cycle2\n",
+		"cycle2":  "# include cycle1\n",
+		"missing": "# include nonexistent\n",
+	}
+	resolve := func(name string) (io.Reader, error) {
+		body, ok := fragments[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return strings.NewReader(body), nil
+	}
+
+	got, err := ParseConfigWithIncludes("top", resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{"A": "n", "B": "y", "NET": "y", "DEBUG": "y", "COMMON": "y"}
+	if !got.Equal(want) {
+		t.Fatalf("ParseConfigWithIncludes: got %#v, want %#v", got, want)
+	}
+
+	_, err = ParseConfigWithIncludes("cycle1", resolve)
+	if err == nil || !strings.Contains(err.Error(), "cycle1 -> cycle2 -> cycle1") {
+		t.Fatalf("ParseConfigWithIncludes on cyclic includes: got error %v", err)
+	}
+
+	_, err = ParseConfigWithIncludes("missing", resolve)
+	if !xerrors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ParseConfigWithIncludes on missing include: got error %v", err)
+	}
+}
+
+func TestRunningConfigFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := io.WriteString(zw, "CONFIG_IKCONFIG=y\nCONFIG_IKCONFIG_PROC=y\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.gz")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := RunningConfigFrom(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{"IKCONFIG": "y", "IKCONFIG_PROC": "y"}
+	if !got.Equal(want) {
+		t.Fatalf("RunningConfigFrom(%q) = %#v, want %#v", path, got, want)
+	}
+
+	diff, err := diffAgainstRunningFrom(path, Config{"IKCONFIG": "y", "IKCONFIG_PROC": "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantdiff := ConfigDiff{
+		Changes: []ConfigChange{
+			{Opt: "IKCONFIG_PROC", OldVal: "y", NewVal: "n"},
+		},
+	}
+	if !reflect.DeepEqual(diff, wantdiff) {
+		t.Fatalf("diffAgainstRunningFrom = %#v, want %#v", diff, wantdiff)
+	}
+	missing := filepath.Join(dir, "missing.gz")
+	if _, err := diffAgainstRunningFrom(missing, Config{}); !xerrors.Is(err, os.ErrNotExist) {
+		t.Fatalf("diffAgainstRunningFrom(%q): got error %v", missing, err)
+	}
+
+	plain := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(plain, []byte("CONFIG_X=y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunningConfigFrom(plain); err == nil {
+		t.Fatalf("RunningConfigFrom(%q) succeeded on uncompressed file", plain)
+	}
+}
+
+func TestParseConfigAuto(t *testing.T) {
+	const input = "CONFIG_IKCONFIG=y\n# CONFIG_SMP is not set\n"
+	want := Config{"IKCONFIG": "y", "SMP": "n"}
+
+	compressed := new(bytes.Buffer)
+	zw := gzip.NewWriter(compressed)
+	if _, err := io.WriteString(zw, input); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name  string
+		Input io.Reader
+		Want  Config
+	}{
+		{Name: "Plain", Input: strings.NewReader(input), Want: want},
+		{Name: "Gzip", Input: compressed, Want: want},
+		{Name: "Empty", Input: strings.NewReader(""), Want: Config{}},
+		{Name: "OneByte", Input: strings.NewReader("\x1f"), Want: Config{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			got, err := ParseConfigAuto(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.Want) {
+				t.Fatalf("got %#v, want %#v", got, tt.Want)
+			}
+		})
+	}
+
+	if _, err := ParseConfigAuto(strings.NewReader("\x1f\x8bgarbage")); err == nil {
+		t.Fatal("ParseConfigAuto succeeded on corrupt gzip input")
+	}
+}
+
+func TestParseConfigFromTar(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	files := []struct {
+		Name, Body string
+	}{
+		{Name: "linux-5.1/Makefile", Body: "VERSION = 5\n"},
+		{Name: "linux-5.1/arch/x86/configs/.config.old", Body: "CONFIG_OLD=y\n"},
+		{Name: "linux-5.1/.config", Body: "CONFIG_SMP=y\n# CONFIG_DEBUG_INFO is not set\n"},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.Name,
+			Mode:     0644,
+			Size:     int64(len(f.Body)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, f.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	got, err := ParseConfigFromTar(bytes.NewReader(archive), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{"SMP": "y", "DEBUG_INFO": "n"}
+	if !got.Equal(want) {
+		t.Fatalf("ParseConfigFromTar: got %#v, want %#v", got, want)
+	}
+
+	if _, err := ParseConfigFromTar(bytes.NewReader(archive), "missing.config"); err == nil {
+		t.Fatal("ParseConfigFromTar succeeded for missing entry")
+	}
+}
+
+func TestTristate(t *testing.T) {
+	cv := ConfigValue{Opt: "USB", Val: "m"}
+	if got, ok := cv.Tristate(); !ok || got != TristateModule {
+		t.Fatalf("%v.Tristate() = %v, %t, want %v, true", cv, got, ok, TristateModule)
+	}
+	cv = ConfigValue{Opt: "NR_CPUS", Val: "64"}
+	if _, ok := cv.Tristate(); ok {
+		t.Fatalf("%v.Tristate() succeeded", cv)
+	}
+	cc := ConfigChange{Opt: "USB", OldVal: "n", NewVal: "y"}
+	if got, ok := cc.OldTristate(); !ok || got != TristateNo {
+		t.Fatalf("%v.OldTristate() = %v, %t, want %v, true", cc, got, ok, TristateNo)
+	}
+	if got, ok := cc.NewTristate(); !ok || got != TristateYes {
+		t.Fatalf("%v.NewTristate() = %v, %t, want %v, true", cc, got, ok, TristateYes)
+	}
+	for _, s := range []string{"n", "m", "y"} {
+		tri, ok := ParseTristate(s)
+		if !ok || tri.String() != s {
+			t.Fatalf("ParseTristate(%q) = %v, %t", s, tri, ok)
+		}
+	}
+}
+
+func TestConfigBuilder(t *testing.T) {
+	b := NewConfigBuilder().
+		Enable("FOO").
+		Disable("BAR").
+		Module("BAZ").
+		Set("NR_CPUS", "64")
+	got := b.Build()
+	want := Config{"FOO": "y", "BAR": "n", "BAZ": "m", "NR_CPUS": "64"}
+	if !got.Equal(want) {
+		t.Fatalf("Build() = %#v, want %#v", got, want)
+	}
+	b.Disable("FOO")
+	if got["FOO"] != "y" {
+		t.Fatalf("Build() result modified by subsequent builder call")
+	}
+}
+
+func TestConfigValidateSchema(t *testing.T) {
+	schema := ConfigSchema{
+		"SMP":            {Kind: KindTristate, Allowed: []string{"y", "n"}},
+		"EXT4_FS":        {Kind: KindTristate},
+		"NR_CPUS":        {Kind: KindInt},
+		"PHYSICAL_START": {Kind: KindHex},
+		"LOCALVERSION":   {Kind: KindString},
+		"UNUSED":         {Kind: KindInt},
+	}
+	valid := Config{
+		"SMP":            "y",
+		"EXT4_FS":        "m",
+		"NR_CPUS":        "64",
+		"PHYSICAL_START": "0x1000000",
+		"LOCALVERSION":   `"-acln"`,
+		"NOT_IN_SCHEMA":  "whatever",
+	}
+	if errs := valid.ValidateSchema(schema); errs != nil {
+		t.Fatalf("ValidateSchema on valid config: %v", errs)
+	}
+	invalid := Config{
+		"SMP":            "m",
+		"EXT4_FS":        "yes",
+		"NR_CPUS":        "0x40",
+		"PHYSICAL_START": "1000000",
+		"LOCALVERSION":   "-acln",
+	}
+	errs := invalid.ValidateSchema(schema)
+	if len(errs) != len(invalid) {
+		t.Fatalf("ValidateSchema on invalid config: got %d errors (%v), want %d",
+			len(errs), errs, len(invalid))
+	}
+	for i, opt := range []string{"EXT4_FS", "LOCALVERSION", "NR_CPUS", "PHYSICAL_START", "SMP"} {
+		if !strings.Contains(errs[i].Error(), opt) {
+			t.Errorf("error %d (%v) does not mention %s", i, errs[i], opt)
+		}
+	}
+}
+
+func TestConfigCheckDeps(t *testing.T) {
+	deps := map[string][]string{
+		"EXT4_FS":        {"BLOCK"},
+		"NF_CONNTRACK":   {"NET", "NETFILTER"},
+		"USB_STORAGE":    {"USB", "SCSI"},
+		"DISABLED_THING": {"MISSING"},
+	}
+	cfg := Config{
+		"EXT4_FS":        "m",
+		"BLOCK":          "y",
+		"NF_CONNTRACK":   "y",
+		"NET":            "y",
+		"NETFILTER":      "n",
+		"USB_STORAGE":    "m",
+		"DISABLED_THING": "n",
+	}
+	errs := cfg.CheckDeps(deps)
+	if len(errs) != 2 {
+		t.Fatalf("CheckDeps: got %d errors (%v), want 2", len(errs), errs)
+	}
+	for i, want := range []string{"NF_CONNTRACK=y: requires NETFILTER,", "USB_STORAGE=m: requires USB, SCSI,"} {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("error %d (%v) does not contain %q", i, errs[i], want)
+		}
+	}
+
+	cfg = cfg.Apply(
+		ConfigValue{Opt: "NETFILTER", Val: "y"},
+		ConfigValue{Opt: "USB_STORAGE", Val: Removed},
+	)
+	if errs := cfg.CheckDeps(deps); errs != nil {
+		t.Fatalf("CheckDeps on consistent config: %v", errs)
+	}
+}
+
+func TestConfigEnableWithDeps(t *testing.T) {
+	deps := map[string][]string{
+		"USB_STORAGE": {"USB", "SCSI"},
+		"SCSI":        {"BLOCK"},
+		"USB":         {"USB_SUPPORT"},
+		"USB_SUPPORT": {"USB"}, // cycle
+		"UNRELATED":   {"NET"},
+	}
+	cfg := Config{"BLOCK": "m", "NET": "n", "USB": "y"}
+	got := cfg.EnableWithDeps("USB_STORAGE", deps)
+	want := Config{
+		"USB_STORAGE": "y",
+		"USB":         "y",
+		"USB_SUPPORT": "y",
+		"SCSI":        "y",
+		"BLOCK":       "y",
+		"NET":         "n",
+	}
+	if !got.Equal(want) {
+		t.Fatalf("EnableWithDeps: got %v, want %v", got, want)
+	}
+	if errs := got.CheckDeps(deps); errs != nil {
+		t.Errorf("CheckDeps after EnableWithDeps: %v", errs)
+	}
+	if cfg["BLOCK"] != "m" || len(cfg) != 3 {
+		t.Errorf("EnableWithDeps modified its receiver: %v", cfg)
+	}
+}
+
+func TestConfigKSPPReport(t *testing.T) {
+	compliant := make(Config)
+	for _, rec := range KSPPOptions {
+		kv := strings.SplitN(rec, "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("malformed KSPPOptions entry %q", rec)
+		}
+		compliant[kv[0]] = kv[1]
+	}
+	if got := compliant.KSPPReport(); len(got) != 0 {
+		t.Fatalf("KSPPReport on compliant config: %v", got)
+	}
+
+	// Options recommended as n may also be absent.
+	delete(compliant, "DEVMEM")
+	if got := compliant.KSPPReport(); len(got) != 0 {
+		t.Fatalf("KSPPReport with DEVMEM absent: %v", got)
+	}
+
+	cfg := compliant.Apply(
+		ConfigValue{Opt: "DEVMEM", Val: "y"},
+		ConfigValue{Opt: "STRICT_KERNEL_RWX", Val: Removed},
+		ConfigValue{Opt: "HARDENED_USERCOPY", Val: "n"},
+	)
+	got := cfg.KSPPReport()
+	want := []ConfigChange{
+		{Opt: "DEVMEM", OldVal: "y", NewVal: "n"},
+		{Opt: "HARDENED_USERCOPY", OldVal: "n", NewVal: "y"},
+		{Opt: "STRICT_KERNEL_RWX", OldVal: "", NewVal: "y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("KSPPReport() = %v, want %v", got, want)
+	}
+}
+
+func TestClassifyValue(t *testing.T) {
+	tests := []struct {
+		Val    string
+		Kind   ValueKind
+		WantOK bool
+	}{
+		{Val: "", Kind: KindEmpty, WantOK: true},
+		{Val: "y", Kind: KindTristate, WantOK: true},
+		{Val: "n", Kind: KindTristate, WantOK: true},
+		{Val: "64", Kind: KindInt, WantOK: true},
+		{Val: "-1", Kind: KindInt, WantOK: true},
+		{Val: "0x1000000", Kind: KindHex, WantOK: true},
+		{Val: `""`, Kind: KindString, WantOK: true},
+		{Val: `"a \"b\""`, Kind: KindString, WantOK: true},
+		{Val: "yes", WantOK: false},
+		{Val: `"unterminated`, WantOK: false},
+	}
+	for _, tt := range tests {
+		kind, ok := ClassifyValue(tt.Val)
+		if ok != tt.WantOK || (ok && kind != tt.Kind) {
+			t.Errorf("ClassifyValue(%q) = %v, %t, want %v, %t", tt.Val, kind, ok, tt.Kind, tt.WantOK)
+		}
+	}
+}
+
+func TestConfigSelectByType(t *testing.T) {
+	cfg := Config{
+		"SMP":            "y",
+		"NR_CPUS":        "64",
+		"HZ":             "250",
+		"PHYSICAL_START": "0x1000000",
+		"LOCALVERSION":   `"-acln"`,
+		"EMPTY":          "",
+		"BOGUS":          "yes",
+	}
+	tests := []struct {
+		Kind ValueKind
+		Want []ConfigValue
+	}{
+		{Kind: KindTristate, Want: []ConfigValue{{Opt: "SMP", Val: "y"}}},
+		{Kind: KindInt, Want: []ConfigValue{{Opt: "HZ", Val: "250"}, {Opt: "NR_CPUS", Val: "64"}}},
+		{Kind: KindHex, Want: []ConfigValue{{Opt: "PHYSICAL_START", Val: "0x1000000"}}},
+		{Kind: KindString, Want: []ConfigValue{{Opt: "LOCALVERSION", Val: `"-acln"`}}},
+		{Kind: KindEmpty, Want: []ConfigValue{{Opt: "EMPTY", Val: ""}}},
+	}
+	for _, tt := range tests {
+		if got := cfg.SelectByType(tt.Kind); !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("SelectByType(%v) = %v, want %v", tt.Kind, got, tt.Want)
+		}
+	}
+}
+
+func TestConfigDiffTypeChanges(t *testing.T) {
+	old := Config{
+		"TRISTATE_TO_INT": "y",
+		"INT_TO_HEX":      "4096",
+		"STRING_TO_EMPTY": `"x"`,
+		"TRISTATE":        "m",
+		"INT":             "64",
+		"WORD_TO_INT":     "bogus",
+		"WORDS":           "foo",
+		"REMOVED":         "y",
+	}
+	cfg := Config{
+		"TRISTATE_TO_INT": "64",
+		"INT_TO_HEX":      "0x1000",
+		"STRING_TO_EMPTY": "",
+		"TRISTATE":        "y",
+		"INT":             "128",
+		"WORD_TO_INT":     "1",
+		"WORDS":           "bar",
+		"ADDED":           "64",
+	}
+	got := DiffConfig(old, cfg).TypeChanges()
+	want := []ConfigChange{
+		{Opt: "INT_TO_HEX", OldVal: "4096", NewVal: "0x1000"},
+		{Opt: "STRING_TO_EMPTY", OldVal: `"x"`, NewVal: ""},
+		{Opt: "TRISTATE_TO_INT", OldVal: "y", NewVal: "64"},
+		{Opt: "WORD_TO_INT", OldVal: "bogus", NewVal: "1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("TypeChanges() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	t.Run("Basic", testDiffConfigBasic)
+	t.Run("Symmetry", testDiffConfigSymmetry)
+	t.Run("IgnoringValues", testDiffConfigIgnoringValues)
+}
+
+func TestStreamDiff(t *testing.T) {
+	// Interleaved options exercise every branch of the merge walk.
+	pairs := [][2]Config{{
+		{"A": "y", "C": "m", "D": "y", "F": "n", "Z": "y"},
+		{"B": "y", "C": "y", "D": "y", "E": "m", "Z": "n", "ZZ": "y"},
+	}}
+	for _, tt := range diffTests {
+		pairs = append(pairs, [2]Config{tt.Old, tt.New})
+	}
+	for _, pair := range pairs {
+		old, cfg := pair[0], pair[1]
+		want := new(bytes.Buffer)
+		if _, err := DiffConfig(old, cfg).WriteTo(want); err != nil {
+			t.Fatal(err)
+		}
+		got := new(bytes.Buffer)
+		n, err := StreamDiff(old, cfg, got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("StreamDiff(%#v, %#v) => %q, want %q", old, cfg, got, want)
+		}
+		if n != int64(got.Len()) {
+			t.Fatalf("StreamDiff reported %d bytes, wrote %d", n, got.Len())
+		}
+	}
+}
+
+func TestConfigsDiffer(t *testing.T) {
+	base := Config{"A": "y", "B": "m", "C": "n"}
+	tests := []struct {
+		Name  string
+		Other Config
+		Want  bool
+	}{
+		{Name: "Equal", Other: Config{"A": "y", "B": "m", "C": "n"}, Want: false},
+		{Name: "Changed", Other: Config{"A": "y", "B": "y", "C": "n"}, Want: true},
+		{Name: "Missing", Other: Config{"A": "y", "B": "m"}, Want: true},
+		{Name: "Extra", Other: Config{"A": "y", "B": "m", "C": "n", "D": "y"}, Want: true},
+		{Name: "Renamed", Other: Config{"A": "y", "B": "m", "D": "n"}, Want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			got := ConfigsDiffer(base, tt.Other)
+			if got != tt.Want {
+				t.Errorf("ConfigsDiffer(%#v, %#v) = %t, want %t", base, tt.Other, got, tt.Want)
+			}
+			diff := DiffConfig(base, tt.Other)
+			nonempty := len(diff.InOld)+len(diff.Changes)+len(diff.InNew) > 0
+			if got != nonempty {
+				t.Errorf("ConfigsDiffer = %t, but DiffConfig found differences: %t", got, nonempty)
+			}
+		})
+	}
+	if ConfigsDiffer(nil, Config{}) {
+		t.Error("nil and empty Config differ")
+	}
+}
+
+func TestConfigSimilarity(t *testing.T) {
+	base := Config{"A": "y", "B": "m", "C": "n", "D": "y"}
+	tests := []struct {
+		Name string
+		A, B Config
+		Want float64
+	}{
+		{Name: "Equal", A: base, B: Config{"A": "y", "B": "m", "C": "n", "D": "y"}, Want: 1},
+		{Name: "BothEmpty", A: nil, B: Config{}, Want: 1},
+		{Name: "OneEmpty", A: base, B: nil, Want: 0},
+		{Name: "Changed", A: base, B: Config{"A": "y", "B": "y", "C": "n", "D": "y"}, Want: 0.75},
+		{Name: "Extra", A: base, B: Config{"A": "y", "B": "m", "C": "n", "D": "y", "E": "y"}, Want: 0.8},
+		{Name: "Disjoint", A: Config{"A": "y"}, B: Config{"B": "y"}, Want: 0},
+		{Name: "Mixed", A: Config{"A": "y", "B": "m"}, B: Config{"B": "y", "C": "y"}, Want: 0},
+		{Name: "Half", A: Config{"A": "y", "B": "m"}, B: Config{"A": "y", "C": "y"}, Want: 1.0 / 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			if got := ConfigSimilarity(tt.A, tt.B); got != tt.Want {
+				t.Errorf("ConfigSimilarity(%#v, %#v) = %v, want %v", tt.A, tt.B, got, tt.Want)
+			}
+			if got := ConfigSimilarity(tt.B, tt.A); got != tt.Want {
+				t.Errorf("ConfigSimilarity(%#v, %#v) = %v, want %v", tt.B, tt.A, got, tt.Want)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	disableDebug := func(cfg Config) Config {
+		for opt := range cfg {
+			if strings.HasPrefix(opt, "DEBUG_") {
+				cfg[opt] = "n"
+			}
+		}
+		return cfg
+	}
+	forceModules := func(cfg Config) Config {
+		return cfg.SetAll([]string{"E1000", "IGB"}, "m")
+	}
+	localVersion := func(cfg Config) Config {
+		return cfg.Apply(ConfigValue{Opt: "LOCALVERSION", Val: `"-test"`})
+	}
+
+	cfg := Config{"DEBUG_INFO": "y", "DEBUG_KERNEL": "y", "E1000": "y", "EXT4_FS": "y"}
+	got := Pipeline(disableDebug, forceModules, localVersion)(cfg)
+	want := Config{
+		"DEBUG_INFO":   "n",
+		"DEBUG_KERNEL": "n",
+		"E1000":        "m",
+		"IGB":          "m",
+		"EXT4_FS":      "y",
+		"LOCALVERSION": `"-test"`,
+	}
+	if !got.Equal(want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+	if cfg["DEBUG_INFO"] != "y" || len(cfg) != 4 {
+		t.Fatalf("Pipeline modified its input: %#v", cfg)
+	}
+
+	// Transforms apply from left to right.
+	setY := func(cfg Config) Config { return cfg.SetAll([]string{"A"}, "y") }
+	setM := func(cfg Config) Config { return cfg.SetAll([]string{"A"}, "m") }
+	if got := Pipeline(setY, setM)(Config{})["A"]; got != "m" {
+		t.Fatalf("Pipeline(setY, setM) set A to %q, want m", got)
+	}
+
+	empty := Pipeline()(cfg)
+	if !empty.Equal(cfg) {
+		t.Fatalf("empty Pipeline: got %#v, want %#v", empty, cfg)
+	}
+	empty["NEW"] = "y"
+	if _, ok := cfg["NEW"]; ok {
+		t.Fatal("empty Pipeline returned its input rather than a copy")
+	}
+}
+
+func TestParseConfigCommands(t *testing.T) {
+	input := `# enable networking
+scripts/config --enable NET -e config_inet --module E1000
+./scripts/config --disable DEBUG_INFO --set-val NR_CPUS 64
+--set-str LOCALVERSION "-my \"custom\" build" --set-str CMDLINE 'console=ttyS0 quiet'
+-k --enable Mixed_Case -E NET IPV6 -u OLD_OPTION --state SMP --file .config
+
+--disable E1000 --module-after NET NETFILTER
+`
+	base := Config{"NET": "y", "E1000": "y", "NR_CPUS": "32", "OLD_OPTION": "y", "SMP": "y"}
+	got, err := ParseConfigCommands(strings.NewReader(input), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConfigDiff{
+		InOld: []ConfigValue{{Opt: "OLD_OPTION", Val: "y"}},
+		Changes: []ConfigChange{
+			{Opt: "E1000", OldVal: "y", NewVal: "n"},
+			{Opt: "NR_CPUS", OldVal: "32", NewVal: "64"},
+		},
+		InNew: []ConfigValue{
+			{Opt: "CMDLINE", Val: `"console=ttyS0 quiet"`},
+			{Opt: "DEBUG_INFO", Val: "n"},
+			{Opt: "INET", Val: "y"},
+			{Opt: "IPV6", Val: "y"},
+			{Opt: "LOCALVERSION", Val: `"-my \"custom\" build"`},
+			{Opt: "Mixed_Case", Val: "y"},
+			{Opt: "NETFILTER", Val: "m"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	applied, err := base.ApplyDiff(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := applied.StringValue("LOCALVERSION"); !ok || s != `-my "custom" build` {
+		t.Errorf("LOCALVERSION = %q, %t, want %q", s, ok, `-my "custom" build`)
+	}
+	if _, ok := applied["OLD_OPTION"]; ok {
+		t.Errorf("OLD_OPTION was not removed")
+	}
+
+	// Against an empty base, everything is new, and removals are no-ops.
+	got, err = ParseConfigCommands(strings.NewReader("--enable NET --undefine OLD_OPTION"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ConfigDiff{InNew: []ConfigValue{{Opt: "NET", Val: "y"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	bad := []string{
+		"--enable",
+		"--set-val NR_CPUS",
+		"--frobnicate FOO",
+		"--set-str FOO \"unterminated",
+		"FOO",
+	}
+	for _, line := range bad {
+		if _, err := ParseConfigCommands(strings.NewReader(line), nil); err == nil {
+			t.Errorf("ParseConfigCommands(%q) succeeded", line)
+		}
+	}
+}
+
+func TestWriterTo(t *testing.T) {
+	old := Config{"A": "y", "B": "m"}
+	cfg := Config{"A": "y", "B": "y", "C": "n"}
+	writers := map[string]io.WriterTo{
+		"Config":      cfg,
+		"ConfigDiff":  DiffConfig(old, cfg),
+		"SymbolTable": mustParseSymbols(t, testSymbols),
+	}
+	for name, wt := range writers {
+		buf := new(bytes.Buffer)
+		n, err := wt.WriteTo(buf)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if n == 0 || n != int64(buf.Len()) {
+			t.Errorf("%s: WriteTo returned %d, but wrote %d bytes", name, n, buf.Len())
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	old := make(Config)
+	for i := 0; i < 20; i++ {
+		old[fmt.Sprintf("OPT_%02d", i)] = "y"
+	}
+	cfg := old.Apply(
+		ConfigValue{Opt: "OPT_00", Val: "m"},
+		ConfigValue{Opt: "OPT_03", Val: Removed},
+		ConfigValue{Opt: "OPT_15", Val: "n"},
+		ConfigValue{Opt: "OPT_19X", Val: "y"},
+	)
+	want := `--- old
++++ new
+@@ -1,7 +1,6 @@
+-CONFIG_OPT_00=y
++CONFIG_OPT_00=m
+ CONFIG_OPT_01=y
+ CONFIG_OPT_02=y
+-CONFIG_OPT_03=y
+ CONFIG_OPT_04=y
+ CONFIG_OPT_05=y
+ CONFIG_OPT_06=y
+@@ -13,8 +12,9 @@
+ CONFIG_OPT_12=y
+ CONFIG_OPT_13=y
+ CONFIG_OPT_14=y
+-CONFIG_OPT_15=y
++# CONFIG_OPT_15 is not set
+ CONFIG_OPT_16=y
+ CONFIG_OPT_17=y
+ CONFIG_OPT_18=y
+ CONFIG_OPT_19=y
++CONFIG_OPT_19X=y
+`
+	buf := new(bytes.Buffer)
+	if err := UnifiedDiff(old, cfg, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("UnifiedDiff wrote\n%s\nwant\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := UnifiedDiff(old, old, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("UnifiedDiff of equal configs wrote %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := UnifiedDiff(Config{}, Config{"A": "y"}, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "--- old\n+++ new\n@@ -0,0 +1 @@\n+CONFIG_A=y\n"; got != want {
+		t.Fatalf("UnifiedDiff from empty config wrote %q, want %q", got, want)
+	}
+}
+
+func TestQuoteValue(t *testing.T) {
+	tests := []struct {
+		S      string
+		Quoted string
+	}{
+		{S: "", Quoted: `""`},
+		{S: "-acln", Quoted: `"-acln"`},
+		{S: "/path/with spaces/initramfs", Quoted: `"/path/with spaces/initramfs"`},
+		{S: `say "hi"`, Quoted: `"say \"hi\""`},
+		{S: `C:\dir\`, Quoted: `"C:\\dir\\"`},
+	}
+	for _, tt := range tests {
+		if got := QuoteValue(tt.S); got != tt.Quoted {
+			t.Errorf("QuoteValue(%q) = %q, want %q", tt.S, got, tt.Quoted)
+		}
+		got, err := UnquoteValue(tt.Quoted)
+		if err != nil {
+			t.Errorf("UnquoteValue(%q): %v", tt.Quoted, err)
+			continue
+		}
+		if got != tt.S {
+			t.Errorf("UnquoteValue(%q) = %q, want %q", tt.Quoted, got, tt.S)
+		}
+	}
+
+	bad := []string{"", `"`, "unquoted", `"a"b"`, `"trailing\"`, `'single'`}
+	for _, val := range bad {
+		if _, err := UnquoteValue(val); err == nil {
+			t.Errorf("UnquoteValue(%q) succeeded", val)
+		}
+	}
+}
+
+func TestConfigLooksFull(t *testing.T) {
+	full := make(Config)
+	for i := 0; i < FullConfigThreshold; i++ {
+		full[fmt.Sprintf("OPT_%d", i)] = "n"
+	}
+	full["MODULES"] = "y"
+	full["PRINTK"] = "y"
+	full["BLOCK"] = "n"
+	if !full.LooksFull() {
+		t.Errorf("full configuration does not look full")
+	}
+
+	fragment := full.Apply(ConfigValue{Opt: "PRINTK", Val: Removed})
+	if fragment.LooksFull() {
+		t.Errorf("large fragment without PRINTK looks full")
+	}
+
+	small := Config{"MODULES": "y", "PRINTK": "y", "BLOCK": "y"}
+	if small.LooksFull() {
+		t.Errorf("small fragment looks full")
+	}
+
+	defer func(threshold int) { FullConfigThreshold = threshold }(FullConfigThreshold)
+	FullConfigThreshold = 3
+	if !small.LooksFull() {
+		t.Errorf("with FullConfigThreshold = 3, %v does not look full", small)
+	}
+}
+
+func TestConfigIntersection(t *testing.T) {
+	old := Config{"A": "y", "B": "m", "C": "n", "D": "y"}
+	new := Config{"A": "y", "B": "y", "C": "n", "E": "y"}
+	got := ConfigIntersection(old, new)
+	want := Config{"A": "y", "C": "n"}
+	if !got.Equal(want) {
+		t.Fatalf("ConfigIntersection(%#v, %#v) = %#v, want %#v", old, new, got, want)
+	}
+	if len(old) != 4 || len(new) != 4 {
+		t.Fatal("ConfigIntersection modified its inputs")
+	}
+}
+
+func TestUniqueOptions(t *testing.T) {
+	configs := map[string]Config{
+		"x86":   {"A": "y", "B": "y", "X86": "y", "PCI": "y"},
+		"arm64": {"A": "y", "B": "m", "ARM64": "y", "PCI": "y", "OF": "y"},
+		"um":    {"A": "y", "UML": "y", "OF": "n"},
+		"empty": {},
+	}
+	got := UniqueOptions(configs)
+	want := map[string][]string{
+		"x86":   {"X86"},
+		"arm64": {"ARM64"},
+		"um":    {"UML"},
+		"empty": nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("UniqueOptions(%#v) = %#v, want %#v", configs, got, want)
+	}
+
+	single := map[string]Config{"only": {"B": "y", "A": "n"}}
+	if got, want := UniqueOptions(single)["only"], []string{"A", "B"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("UniqueOptions with a single config = %q, want %q", got, want)
+	}
 }
 
-func TestDiffConfig(t *testing.T) {
-	t.Run("Basic", testDiffConfigBasic)
-	t.Run("Symmetry", testDiffConfigSymmetry)
+func TestMinimalEnableDiff(t *testing.T) {
+	base := Config{"A": "y", "B": "n", "C": "m", "D": "y"}
+	want := map[string]string{"A": "y", "B": "y", "E": "m"}
+	diff := MinimalEnableDiff(base, want)
+	wantdiff := ConfigDiff{
+		Changes: []ConfigChange{
+			{Opt: "B", OldVal: "n", NewVal: "y"},
+		},
+		InNew: []ConfigValue{
+			{Opt: "E", Val: "m"},
+		},
+	}
+	if !reflect.DeepEqual(diff, wantdiff) {
+		t.Fatalf("MinimalEnableDiff(%#v, %#v) = %#v, want %#v", base, want, diff, wantdiff)
+	}
+	got, err := base.ApplyDiff(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for opt, val := range want {
+		if got[opt] != val {
+			t.Fatalf("after applying %#v: %s = %q, want %q", diff, opt, got[opt], val)
+		}
+	}
 }
 
 func TestConfigDiff(t *testing.T) {
 	t.Run("WriteTo", testConfigDiffWriteTo)
 	t.Run("WriteToPredictableOrder", testConfigDiffWriteToPredictableOrder)
+	t.Run("WriteColored", testConfigDiffWriteColored)
+	t.Run("WriteChangesOnly", testConfigDiffWriteChangesOnly)
+	t.Run("WriteGrouped", testConfigDiffWriteGrouped)
+	t.Run("PromotionsDemotions", testConfigDiffPromotionsDemotions)
+	t.Run("SortTies", testConfigDiffSortTies)
+	t.Run("TouchedOptions", testConfigDiffTouchedOptions)
+	t.Run("Classify", testConfigDiffClassify)
+	t.Run("Preconditions", testConfigDiffPreconditions)
+	t.Run("Split", testConfigDiffSplit)
+	t.Run("Normalize", testConfigDiffNormalize)
 }
 
 func testConfigParse(t *testing.T) {
@@ -51,6 +1091,92 @@ func testConfigParse(t *testing.T) {
 	}
 }
 
+func testConfigParseByteOrderMark(t *testing.T) {
+	input := "\ufeffCONFIG_FOO=y\nCONFIG_BAR=m\n"
+	cfg, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg["FOO"], "y"; got != want {
+		t.Fatalf("ParseConfig(%q): FOO = %q, want %q", input, got, want)
+	}
+	want := Config{"FOO": "y", "BAR": "m"}
+	if !cfg.Equal(want) {
+		t.Fatalf("ParseConfig(%q): got %#v, want %#v", input, cfg, want)
+	}
+}
+
+func testConfigParseNotSetSpacing(t *testing.T) {
+	lines := []string{
+		"# CONFIG_X is not set",
+		"#CONFIG_X is not set",
+		"#  CONFIG_X is not set",
+		"#\tCONFIG_X is not set",
+		"CONFIG_X is not set",
+		"  # CONFIG_X is not set  ",
+	}
+	for _, line := range lines {
+		opt, val := parseConfigLine(line)
+		if opt != "X" || val != "n" {
+			t.Errorf("parseConfigLine(%q) = %q, %q, want %q, %q", line, opt, val, "X", "n")
+		}
+	}
+	ignored := []string{
+		"# Some feature is not set",
+		"# CONFIG_ is not set",
+		"# General setup",
+		"# CONFIG_X=y is not set",
+	}
+	for _, line := range ignored {
+		if opt, val := parseConfigLine(line); opt != "" || val != "" {
+			t.Errorf("parseConfigLine(%q) = %q, %q, want empty strings", line, opt, val)
+		}
+	}
+
+	// Assignments whose values happen to end in " is not set" are still
+	// assignments.
+	cfg, err := ParseConfig(strings.NewReader("CONFIG_FOO=bar is not set\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Config{"FOO": "bar is not set"}); !cfg.Equal(want) {
+		t.Errorf("got %v, want %v", cfg, want)
+	}
+}
+
+func testConfigParseExtra(t *testing.T) {
+	input := "# comment\n" +
+		"CONFIG_A=y\n" +
+		"KBUILD_BUILD_USER=builder\n" +
+		"# CONFIG_B is not set\n" +
+		"\n" +
+		"this line is not an assignment\n" +
+		"a b=c\n" +
+		"=oops\n" +
+		"  ARCH = x86\n" +
+		"CONFIG_C=\"x=y\"\n"
+	cfg, extra, err := ParseConfigExtra(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{"A": "y", "B": "n", "C": `"x=y"`}
+	if !cfg.Equal(want) {
+		t.Errorf("got %#v, want %#v", cfg, want)
+	}
+	wantExtra := []string{"KBUILD_BUILD_USER=builder", "  ARCH = x86"}
+	if !reflect.DeepEqual(extra, wantExtra) {
+		t.Errorf("got extra lines %q, want %q", extra, wantExtra)
+	}
+
+	plain, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plain.Equal(cfg) {
+		t.Errorf("ParseConfig and ParseConfigExtra disagree: %#v vs. %#v", plain, cfg)
+	}
+}
+
 func testConfigEqual(t *testing.T) {
 	cfg := Config{"X": "n", "Y": "y", "Z": `""`}
 	if !cfg.Equal(cfg) {
@@ -68,79 +1194,483 @@ func testConfigEqual(t *testing.T) {
 	}
 }
 
-func testConfigWriteTo(t *testing.T) {
-	t.Run("Basic", func(t *testing.T) {
-		buf := new(bytes.Buffer)
-		cfg := Config{
-			"FOO":  "n",
-			"BAR":  "y",
-			"BAZ":  `""`,
-			"QUUX": "42",
-		}
-		wantsb := new(strings.Builder)
-		wantsb.WriteString(`CONFIG_BAR=y` + "\n")
-		wantsb.WriteString(`CONFIG_BAZ=""` + "\n")
-		wantsb.WriteString(`# CONFIG_FOO is not set` + "\n")
-		wantsb.WriteString(`CONFIG_QUUX=42` + "\n")
-		if _, err := cfg.WriteTo(buf); err != nil {
-			t.Fatal(err)
-		}
-		if got, want := buf.String(), wantsb.String(); got != want {
-			t.Fatalf("%#v.WriteTo() => %q, want %q", cfg, got, want)
-		}
-	})
-	t.Run("Nil", func(t *testing.T) {
-		defer func() {
-			if r := recover(); r != nil {
-				t.Fatal("WriteTo crashed on nil Config")
-			}
-		}()
-		buf := new(bytes.Buffer)
-		var cfg Config
-		if _, err := cfg.WriteTo(buf); err != nil {
-			t.Fatal(err)
-		}
-		if len(buf.Bytes()) != 0 {
-			t.Fatalf("nil Config.WriteTo produced output")
-		}
-	})
-	t.Run("Empty", func(t *testing.T) {
-		defer func() {
-			if r := recover(); r != nil {
-				t.Fatal("WriteTo crashed on empty Config")
-			}
-		}()
-		buf := new(bytes.Buffer)
-		cfg := make(Config)
-		if _, err := cfg.WriteTo(buf); err != nil {
-			t.Fatal(err)
-		}
-		if len(buf.Bytes()) != 0 {
-			t.Fatalf("empty Config.WriteTo produced output")
-		}
-	})
+func testConfigEqualNormalized(t *testing.T) {
+	parsed, err := ParseConfig(strings.NewReader(`CONFIG_Z=""` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parsed["Z"], `""`; got != want {
+		t.Fatalf("parsed Z = %q, want %q", got, want)
+	}
+	manual := Config{"Z": ""}
+	if parsed.Equal(manual) {
+		t.Fatalf("%#v.Equal(%#v): unexpectedly true", parsed, manual)
+	}
+	if !parsed.EqualNormalized(manual) || !manual.EqualNormalized(parsed) {
+		t.Fatalf("%#v and %#v not equal after normalization", parsed, manual)
+	}
+	others := []Config{
+		{"Z": `"x"`},
+		{"Z": "", "T": "y"},
+		{},
+	}
+	for _, other := range others {
+		if parsed.EqualNormalized(other) {
+			t.Fatalf("%#v.EqualNormalized(%#v): unexpectedly true", parsed, other)
+		}
+	}
+}
+
+func testConfigAssertEqual(t *testing.T) {
+	cfg := Config{"A": "y", "B": "m", "C": "n"}
+	if err := cfg.AssertEqual(Config{"C": "n", "B": "m", "A": "y"}); err != nil {
+		t.Fatalf("AssertEqual on equal configs: %v", err)
+	}
+	err := cfg.AssertEqual(Config{"A": "y", "B": "y", "D": "m"})
+	if err == nil {
+		t.Fatal("AssertEqual succeeded on unequal configs")
+	}
+	if !xerrors.Is(err, ErrConfigsUnequal) {
+		t.Errorf("error %v does not match ErrConfigsUnequal", err)
+	}
+	for _, line := range []string{"-C n", " B m -> y", "+D m"} {
+		if !strings.Contains(err.Error(), line) {
+			t.Errorf("error %q does not contain %q", err, line)
+		}
+	}
+}
+
+func testConfigCanonicalize(t *testing.T) {
+	cfg := Config{
+		"SMP":          "Y",
+		"EXT4_FS":      "m",
+		"PHYS":         "0X1000ABC",
+		"HZ":           "250",
+		"LOCALVERSION": `"-a\b"`,
+		"QUOTE":        `"say \"hi\""`,
+		"EMPTY":        "",
+		"WORD":         "Yes",
+	}
+	got := cfg.Canonicalize()
+	want := Config{
+		"SMP":          "y",
+		"EXT4_FS":      "m",
+		"PHYS":         "0x1000abc",
+		"HZ":           "250",
+		"LOCALVERSION": `"-ab"`,
+		"QUOTE":        `"say \"hi\""`,
+		"EMPTY":        `""`,
+		"WORD":         "Yes",
+	}
+	if !got.Equal(want) {
+		t.Fatalf("Canonicalize() = %#v, want %#v", got, want)
+	}
+	if cfg["SMP"] != "Y" {
+		t.Fatal("Canonicalize modified its receiver")
+	}
+
+	other := Config{"SMP": "y", "EXT4_FS": "M", "PHYS": "0x1000Abc", "HZ": "250",
+		"LOCALVERSION": `"-ab"`, "QUOTE": `"say \"hi\""`, "EMPTY": `""`, "WORD": "Yes"}
+	if !other.Canonicalize().Equal(got) {
+		t.Fatalf("differently formatted configs are not Equal after Canonicalize")
+	}
+}
+
+func testConfigWriteTo(t *testing.T) {
+	t.Run("Basic", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		cfg := Config{
+			"FOO":  "n",
+			"BAR":  "y",
+			"BAZ":  `""`,
+			"QUUX": "42",
+		}
+		wantsb := new(strings.Builder)
+		wantsb.WriteString(`CONFIG_BAR=y` + "\n")
+		wantsb.WriteString(`CONFIG_BAZ=""` + "\n")
+		wantsb.WriteString(`# CONFIG_FOO is not set` + "\n")
+		wantsb.WriteString(`CONFIG_QUUX=42` + "\n")
+		if _, err := cfg.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := buf.String(), wantsb.String(); got != want {
+			t.Fatalf("%#v.WriteTo() => %q, want %q", cfg, got, want)
+		}
+	})
+	t.Run("Nil", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatal("WriteTo crashed on nil Config")
+			}
+		}()
+		buf := new(bytes.Buffer)
+		var cfg Config
+		if _, err := cfg.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if len(buf.Bytes()) != 0 {
+			t.Fatalf("nil Config.WriteTo produced output")
+		}
+	})
+	t.Run("Empty", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatal("WriteTo crashed on empty Config")
+			}
+		}()
+		buf := new(bytes.Buffer)
+		cfg := make(Config)
+		if _, err := cfg.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if len(buf.Bytes()) != 0 {
+			t.Fatalf("empty Config.WriteTo produced output")
+		}
+	})
+}
+
+func testConfigMarshalText(t *testing.T) {
+	cfg := Config{
+		"FOO":  "n",
+		"BAR":  "y",
+		"BAZ":  `""`,
+		"QUUX": "42",
+		"NAME": `"hello world"`,
+	}
+	text, err := cfg.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := cfg.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(text), buf.String(); got != want {
+		t.Fatalf("MarshalText() => %q, want %q", got, want)
+	}
+
+	got := Config{"STALE": "y"}
+	if err := got.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(cfg) {
+		t.Fatalf("round trip: got %#v, want %#v", got, cfg)
+	}
+
+	var empty Config
+	if err := empty.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if !empty.Equal(cfg) {
+		t.Fatalf("round trip into nil Config: got %#v, want %#v", empty, cfg)
+	}
+}
+
+func testConfigWriteToPredictableOrder(t *testing.T) {
+	cfg := Config{
+		"FOO":  "n",
+		"BAR":  "y",
+		"BAZ":  `""`,
+		"QUUX": "42",
+	}
+	wantsb := new(strings.Builder)
+	wantsb.WriteString(`CONFIG_BAR=y` + "\n")
+	wantsb.WriteString(`CONFIG_BAZ=""` + "\n")
+	wantsb.WriteString(`# CONFIG_FOO is not set` + "\n")
+	wantsb.WriteString(`CONFIG_QUUX=42` + "\n")
+	for i := 0; i < 1000; i++ {
+		buf := new(bytes.Buffer)
+		if _, err := cfg.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := buf.String(), wantsb.String(); got != want {
+			t.Fatalf("%#v.WriteTo() => %q, want %q", cfg, got, want)
+		}
+	}
+}
+
+func testConfigGroupByPrefix(t *testing.T) {
+	cfg := Config{
+		"NET":         "y",
+		"NET_IPV4":    "y",
+		"NET_IPV6":    "m",
+		"USB_STORAGE": "m",
+		"SMP":         "y",
+	}
+	got := cfg.GroupByPrefix("_")
+	want := map[string]Config{
+		"NET": {"NET": "y", "NET_IPV4": "y", "NET_IPV6": "m"},
+		"USB": {"USB_STORAGE": "m"},
+		"SMP": {"SMP": "y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%#v.GroupByPrefix(%q) = %#v, want %#v", cfg, "_", got, want)
+	}
+}
+
+func testConfigWriteTree(t *testing.T) {
+	cfg := Config{
+		"NET":               "y",
+		"NET_IPV4":          "y",
+		"NET_IPV6":          "m",
+		"EXT4_FS":           "m",
+		"EXT4_FS_SECURITY":  "y",
+		"USB_STORAGE":       "m",
+		"USB_SERIAL_FTDI":   "m",
+		"USB_SERIAL_PL2303": "m",
+		"SMP":               "y",
+	}
+	want := `EXT4_FS m
+  SECURITY y
+NET y
+  IPV4 y
+  IPV6 m
+SMP y
+USB
+  SERIAL
+    FTDI m
+    PL2303 m
+  STORAGE m
+`
+	for i := 0; i < 100; i++ {
+		buf := new(bytes.Buffer)
+		n, err := cfg.WriteTree(buf, "_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(buf.Len()) {
+			t.Fatalf("WriteTree returned %d, but wrote %d bytes", n, buf.Len())
+		}
+		if got := buf.String(); got != want {
+			t.Fatalf("WriteTree wrote\n%s\nwant\n%s", got, want)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := (Config{"B": "y", "A_X": "n"}).WriteTree(buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "A_X n\nB y\n"; got != want {
+		t.Fatalf("WriteTree with empty separator wrote %q, want %q", got, want)
+	}
+}
+
+func testConfigGet(t *testing.T) {
+	cfg := Config{"A": "y", "B": "m", "C": "n", "D": "64"}
+	if got := cfg.Get("D", "32"); got != "64" {
+		t.Errorf("Get(%q, %q) = %q, want %q", "D", "32", got, "64")
+	}
+	if got := cfg.Get("E", "32"); got != "32" {
+		t.Errorf("Get(%q, %q) = %q, want %q", "E", "32", got, "32")
+	}
+	enabled := map[string]bool{"A": true, "B": true, "C": false, "D": false, "E": false}
+	for opt, want := range enabled {
+		if got := cfg.IsEnabled(opt); got != want {
+			t.Errorf("IsEnabled(%q) = %t, want %t", opt, got, want)
+		}
+	}
+}
+
+func testConfigGetFold(t *testing.T) {
+	cfg := Config{"MODULES": "y", "Hz": "100", "HZ": "250", "hz": "300"}
+	tests := []struct {
+		Opt    string
+		WantOK bool
+		Want   string
+	}{
+		{Opt: "MODULES", WantOK: true, Want: "y"},
+		{Opt: "modules", WantOK: true, Want: "y"},
+		{Opt: "Modules", WantOK: true, Want: "y"},
+		{Opt: "hz", WantOK: true, Want: "300"},
+		{Opt: "hZ", WantOK: true, Want: "250"},
+		{Opt: "SMP", WantOK: false, Want: ""},
+	}
+	for _, tt := range tests {
+		got, ok := cfg.GetFold(tt.Opt)
+		if got != tt.Want || ok != tt.WantOK {
+			t.Errorf("GetFold(%q) = %q, %t, want %q, %t", tt.Opt, got, ok, tt.Want, tt.WantOK)
+		}
+	}
+}
+
+func testConfigNonDefault(t *testing.T) {
+	cfg := Config{"SMP": "y", "NR_CPUS": "64", "HZ": "250", "EXT4_FS": "m", "LOCAL": `"-x"`}
+	defaults := map[string]string{"SMP": "y", "NR_CPUS": "8", "HZ": "250", "EXT4_FS": "y", "UNUSED": "n"}
+	got := cfg.NonDefault(defaults)
+	want := Config{"NR_CPUS": "64", "EXT4_FS": "m", "LOCAL": `"-x"`}
+	if !got.Equal(want) {
+		t.Fatalf("NonDefault() = %#v, want %#v", got, want)
+	}
+}
+
+func testConfigObsolete(t *testing.T) {
+	cfg := Config{"MODULES": "y", "IDE": "y", "SMP": "y", "OLD_SIGSUSPEND": "n", "EXT4_FS": "m"}
+	valid := map[string]bool{"MODULES": true, "SMP": true, "EXT4_FS": true, "IDE": false}
+	got := cfg.Obsolete(valid)
+	want := []string{"IDE", "OLD_SIGSUSPEND"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Obsolete() = %q, want %q", got, want)
+	}
+	if got := (Config{"SMP": "y"}).Obsolete(valid); len(got) != 0 {
+		t.Fatalf("Obsolete() = %q, want none", got)
+	}
+}
+
+func testConfigForbid(t *testing.T) {
+	forbidden := map[string]string{
+		"DEVMEM":     "y",
+		"PROC_KCORE": "y",
+		"KEXEC":      "y",
+		"COMPAT_BRK": "y",
+	}
+	cfg := Config{"DEVMEM": "y", "PROC_KCORE": "n", "COMPAT_BRK": "y"}
+	got := cfg.Forbid(forbidden)
+	want := []ConfigValue{
+		{Opt: "COMPAT_BRK", Val: "y"},
+		{Opt: "DEVMEM", Val: "y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Forbid() = %v, want %v", got, want)
+	}
+	compliant := Config{"DEVMEM": "n"}
+	if got := compliant.Forbid(forbidden); len(got) != 0 {
+		t.Fatalf("Forbid() on compliant config = %v", got)
+	}
+}
+
+func testConfigStringValue(t *testing.T) {
+	input := `CONFIG_INITRAMFS_SOURCE="/path/with spaces/initramfs \"v2\".cpio"` + "\n" +
+		`CONFIG_EMPTY=""` + "\n" +
+		`CONFIG_MODULES=y` + "\n"
+	cfg, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := cfg.StringValue("INITRAMFS_SOURCE")
+	if want := `/path/with spaces/initramfs "v2".cpio`; !ok || got != want {
+		t.Errorf("StringValue(INITRAMFS_SOURCE) = %q, %t, want %q, true", got, ok, want)
+	}
+	if got, ok := cfg.StringValue("EMPTY"); !ok || got != "" {
+		t.Errorf("StringValue(EMPTY) = %q, %t, want \"\", true", got, ok)
+	}
+	if _, ok := cfg.StringValue("MODULES"); ok {
+		t.Error("StringValue(MODULES) succeeded on a tristate option")
+	}
+	if _, ok := cfg.StringValue("MISSING"); ok {
+		t.Error("StringValue(MISSING) succeeded on a missing option")
+	}
+
+	// WriteTo must reproduce the quoting exactly, so the output parses
+	// back to the same value.
+	buf := new(bytes.Buffer)
+	if _, err := cfg.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), strings.SplitN(input, "\n", 2)[0]+"\n") {
+		t.Fatalf("WriteTo did not preserve quoting:\n%s", buf.String())
+	}
+	reparsed, err := ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reparsed.Equal(cfg) {
+		t.Fatalf("round trip: got %#v, want %#v", reparsed, cfg)
+	}
+}
+
+func testConfigStringList(t *testing.T) {
+	input := `CONFIG_CMDLINE="console=ttyS0,115200 root=/dev/sda1  quiet"` + "\n" +
+		"CONFIG_NR_CPUS=64\n" +
+		"CONFIG_SMP=y\n" +
+		`CONFIG_EMPTY=""` + "\n"
+	cfg, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Opt    string
+		Want   []string
+		WantOK bool
+	}{
+		{Opt: "CMDLINE", Want: []string{"console=ttyS0,115200", "root=/dev/sda1", "quiet"}, WantOK: true},
+		{Opt: "EMPTY", Want: []string{}, WantOK: true},
+		{Opt: "NR_CPUS", WantOK: false},
+		{Opt: "SMP", WantOK: false},
+		{Opt: "MISSING", WantOK: false},
+	}
+	for _, tt := range tests {
+		got, ok := cfg.StringList(tt.Opt)
+		if ok != tt.WantOK {
+			t.Fatalf("StringList(%q): got ok == %t, want %t", tt.Opt, ok, tt.WantOK)
+		}
+		if ok && !reflect.DeepEqual(got, tt.Want) {
+			t.Fatalf("StringList(%q) = %q, want %q", tt.Opt, got, tt.Want)
+		}
+	}
+}
+
+func testConfigLocalVersion(t *testing.T) {
+	cfg := Config{
+		"LOCALVERSION":      `"-acln"`,
+		"LOCALVERSION_AUTO": "n",
+	}
+	if got, want := cfg.LocalVersion(), "-acln"; got != want {
+		t.Fatalf("LocalVersion() = %q, want %q", got, want)
+	}
+	if enabled, ok := cfg.LocalVersionAuto(); enabled || !ok {
+		t.Fatalf("LocalVersionAuto() = %t, %t, want false, true", enabled, ok)
+	}
+	empty := Config{}
+	if got := empty.LocalVersion(); got != "" {
+		t.Fatalf("LocalVersion() on empty config = %q, want empty", got)
+	}
+	if enabled, ok := empty.LocalVersionAuto(); enabled || ok {
+		t.Fatalf("LocalVersionAuto() on empty config = %t, %t, want false, false", enabled, ok)
+	}
+}
+
+func testConfigWriteToExplicit(t *testing.T) {
+	cfg := Config{
+		"FOO": "n",
+		"BAR": "y",
+		"BAZ": `""`,
+	}
+	buf := new(bytes.Buffer)
+	if _, err := cfg.WriteToExplicit(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "CONFIG_BAR=y\nCONFIG_BAZ=\"\"\nCONFIG_FOO=n\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("%#v.WriteToExplicit() => %q, want %q", cfg, got, want)
+	}
+	parsed, err := ParseConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(cfg) {
+		t.Fatalf("round trip: got %#v, want %#v", parsed, cfg)
+	}
 }
 
-func testConfigWriteToPredictableOrder(t *testing.T) {
+func testConfigWriteMakefile(t *testing.T) {
 	cfg := Config{
 		"FOO":  "n",
 		"BAR":  "y",
-		"BAZ":  `""`,
+		"BAZ":  `"baz"`,
 		"QUUX": "42",
 	}
-	wantsb := new(strings.Builder)
-	wantsb.WriteString(`CONFIG_BAR=y` + "\n")
-	wantsb.WriteString(`CONFIG_BAZ=""` + "\n")
-	wantsb.WriteString(`# CONFIG_FOO is not set` + "\n")
-	wantsb.WriteString(`CONFIG_QUUX=42` + "\n")
-	for i := 0; i < 1000; i++ {
-		buf := new(bytes.Buffer)
-		if _, err := cfg.WriteTo(buf); err != nil {
-			t.Fatal(err)
-		}
-		if got, want := buf.String(), wantsb.String(); got != want {
-			t.Fatalf("%#v.WriteTo() => %q, want %q", cfg, got, want)
-		}
+	buf := new(bytes.Buffer)
+	n, err := cfg.WriteMakefile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "CONFIG_BAR := y\nCONFIG_BAZ := \"baz\"\nCONFIG_QUUX := 42\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("%#v.WriteMakefile() => %q, want %q", cfg, got, want)
+	}
+	if n != int64(len(want)) {
+		t.Fatalf("%#v.WriteMakefile() reported %d bytes, wrote %d", cfg, n, len(want))
 	}
 }
 
@@ -284,6 +1814,245 @@ func testApplyDiff(t *testing.T) {
 	}
 }
 
+func testApplyDiffBestEffort(t *testing.T) {
+	cfg := Config{
+		"GONE":     "y",
+		"CHANGE":   "m",
+		"DRIFTED":  "n",
+		"DONE":     "y",
+		"CONFLICT": "m",
+		"SAME":     "y",
+	}
+	diff := ConfigDiff{
+		InOld: []ConfigValue{{Opt: "GONE", Val: "m"}, {Opt: "ALREADY_GONE", Val: "y"}},
+		Changes: []ConfigChange{
+			{Opt: "CHANGE", OldVal: "m", NewVal: "y"},
+			{Opt: "DRIFTED", OldVal: "m", NewVal: "y"},
+			{Opt: "DONE", OldVal: "m", NewVal: "y"},
+			{Opt: "MISSING", OldVal: "m", NewVal: "y"},
+		},
+		InNew: []ConfigValue{
+			{Opt: "ADDED", Val: "y"},
+			{Opt: "CONFLICT", Val: "y"},
+			{Opt: "SAME", Val: "y"},
+		},
+	}
+	got, skipped := cfg.ApplyDiffBestEffort(diff)
+	want := Config{
+		"CHANGE":   "y",
+		"DRIFTED":  "n",
+		"DONE":     "y",
+		"CONFLICT": "m",
+		"SAME":     "y",
+		"ADDED":    "y",
+	}
+	if !got.Equal(want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	wantSkipped := []ConfigValue{
+		{Opt: "DRIFTED", Val: "y"},
+		{Opt: "MISSING", Val: "y"},
+		{Opt: "CONFLICT", Val: "y"},
+	}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("skipped %v, want %v", skipped, wantSkipped)
+	}
+	if cfg["CHANGE"] != "m" || len(cfg) != 6 {
+		t.Errorf("ApplyDiffBestEffort modified its receiver: %#v", cfg)
+	}
+
+	// On a config to which the diff applies cleanly, the result matches
+	// ApplyDiff.
+	base := Config{"A": "y", "B": "m"}
+	target := Config{"B": "y", "C": "m"}
+	clean, skipped := base.ApplyDiffBestEffort(DiffConfig(base, target))
+	if !clean.Equal(target) || len(skipped) != 0 {
+		t.Errorf("clean apply: got %#v, skipped %v, want %#v", clean, skipped, target)
+	}
+}
+
+func testConfigDiffTo(t *testing.T) {
+	cfg := Config{"A": "n", "B": "y", "C": "m"}
+	target := Config{"A": "y", "B": "y", "D": "m"}
+	diff := cfg.DiffTo(target)
+	if want := DiffConfig(cfg, target); !reflect.DeepEqual(diff, want) {
+		t.Fatalf("DiffTo: got %#v, want %#v", diff, want)
+	}
+	got, err := cfg.ApplyDiff(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(target) {
+		t.Fatalf("applying DiffTo: got %#v, want %#v", got, target)
+	}
+}
+
+func testConfigWriteChangelog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseline := Config{"A": "n", "B": "y", "C": "m"}
+	basebuf := new(bytes.Buffer)
+	if _, err := baseline.WriteTo(basebuf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, basebuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{"A": "y", "B": "y", "D": "m"}
+	got := new(bytes.Buffer)
+	if err := cfg.WriteChangelog(got, path); err != nil {
+		t.Fatal(err)
+	}
+	want := new(bytes.Buffer)
+	if _, err := DiffConfig(baseline, cfg).WriteTo(want); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Fatalf("WriteChangelog wrote\n%s\nwant\n%s", got.String(), want.String())
+	}
+
+	missing := filepath.Join(dir, "missing")
+	err = cfg.WriteChangelog(ioutil.Discard, missing)
+	if err == nil {
+		t.Fatal("WriteChangelog succeeded with a missing baseline")
+	}
+	if !strings.Contains(err.Error(), missing) {
+		t.Errorf("error %q does not mention the path %q", err, missing)
+	}
+	var perr *os.PathError
+	if !xerrors.As(err, &perr) {
+		t.Errorf("error %v does not wrap an *os.PathError", err)
+	}
+}
+
+func testConfigDiffAgainst(t *testing.T) {
+	baseline := Config{"A": "n", "B": "y", "C": "m", "D": "64"}
+	cfg := Config{"A": "m", "B": "m", "D": "32", "E": "y"}
+	diff, stats := cfg.DiffAgainst(baseline)
+	if want := DiffConfig(baseline, cfg); !reflect.DeepEqual(diff, want) {
+		t.Fatalf("DiffAgainst: got diff %#v, want %#v", diff, want)
+	}
+	want := DiffStats{InOld: 1, Changes: 3, InNew: 1, Promotions: 1, Demotions: 1}
+	if stats != want {
+		t.Fatalf("DiffAgainst: got stats %+v, want %+v", stats, want)
+	}
+}
+
+func testConfigApply(t *testing.T) {
+	cfg := Config{"A": "y", "B": "m", "C": "n"}
+	got := cfg.Apply(
+		ConfigValue{Opt: "A", Val: "n"},
+		ConfigValue{Opt: "B", Val: Removed},
+		ConfigValue{Opt: "D", Val: "m"},
+		ConfigValue{Opt: "D", Val: "y"},
+	)
+	want := Config{"A": "n", "C": "n", "D": "y"}
+	if !got.Equal(want) {
+		t.Fatalf("Apply: got %#v, want %#v", got, want)
+	}
+	orig := Config{"A": "y", "B": "m", "C": "n"}
+	if !cfg.Equal(orig) {
+		t.Fatalf("Apply modified the original config: got %#v, want %#v", cfg, orig)
+	}
+}
+
+func testConfigRename(t *testing.T) {
+	cfg := Config{
+		"OLD":       "y",
+		"KEEP":      "m",
+		"DUP_OLD":   "y",
+		"DUP_NEW":   "n",
+		"SWAP_A":    "a",
+		"SWAP_B":    "b",
+		"MERGE_1":   "1",
+		"MERGE_2":   "2",
+		"UNTOUCHED": "64",
+	}
+	renames := map[string]string{
+		"OLD":     "NEW",
+		"DUP_OLD": "DUP_NEW",
+		"SWAP_A":  "SWAP_B",
+		"SWAP_B":  "SWAP_A",
+		"MERGE_1": "MERGED",
+		"MERGE_2": "MERGED",
+		"ABSENT":  "WHATEVER",
+	}
+	got, collisions := cfg.Rename(renames)
+	want := Config{
+		"NEW":       "y",
+		"KEEP":      "m",
+		"DUP_NEW":   "n",
+		"SWAP_A":    "b",
+		"SWAP_B":    "a",
+		"MERGED":    "1",
+		"UNTOUCHED": "64",
+	}
+	if !got.Equal(want) {
+		t.Errorf("Rename: got %#v, want %#v", got, want)
+	}
+	if wantCollisions := []string{"DUP_OLD", "MERGE_2"}; !reflect.DeepEqual(collisions, wantCollisions) {
+		t.Errorf("Rename: got collisions %q, want %q", collisions, wantCollisions)
+	}
+	if cfg["OLD"] != "y" || len(cfg) != 9 {
+		t.Errorf("Rename modified its receiver: %#v", cfg)
+	}
+}
+
+func testConfigSetAll(t *testing.T) {
+	cfg := Config{"DEBUG_INFO": "y", "DEBUG_KERNEL": "y", "SMP": "y"}
+	got := cfg.SetAll([]string{"DEBUG_INFO", "DEBUG_KERNEL", "DEBUG_LIST"}, "n")
+	want := Config{"DEBUG_INFO": "n", "DEBUG_KERNEL": "n", "DEBUG_LIST": "n", "SMP": "y"}
+	if !got.Equal(want) {
+		t.Fatalf("SetAll: got %#v, want %#v", got, want)
+	}
+	if cfg["DEBUG_INFO"] != "y" || len(cfg) != 3 {
+		t.Fatalf("SetAll modified the original config: %#v", cfg)
+	}
+}
+
+func testConfigSearch(t *testing.T) {
+	cfg := Config{
+		"USB_STORAGE":  "m",
+		"SMP":          "y",
+		"DEFAULT_HOST": `"usbhost"`,
+		"NET":          "y",
+	}
+	got := cfg.Search("Usb")
+	want := []ConfigValue{
+		{Opt: "DEFAULT_HOST", Val: `"usbhost"`},
+		{Opt: "USB_STORAGE", Val: "m"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Search(%q) = %v, want %v", "Usb", got, want)
+	}
+	if got := cfg.Search("nothing"); len(got) != 0 {
+		t.Fatalf("Search(%q) = %v, want no results", "nothing", got)
+	}
+}
+
+func testConfigByValue(t *testing.T) {
+	cfg := Config{"C": "y", "A": "y", "B": "m", "D": "64", "E": "64"}
+	got := cfg.ByValue()
+	want := map[string][]string{
+		"y":  {"A", "C"},
+		"m":  {"B"},
+		"64": {"D", "E"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ByValue() = %v, want %v", got, want)
+	}
+	var empty Config
+	if got := empty.ByValue(); got == nil || len(got) != 0 {
+		t.Fatalf("ByValue() on nil Config = %#v, want empty map", got)
+	}
+}
+
 var diffTests = []struct {
 	Old, New Config
 	Want     ConfigDiff
@@ -364,6 +2133,28 @@ func testDiffConfigSymmetry(t *testing.T) {
 	}
 }
 
+func testDiffConfigIgnoringValues(t *testing.T) {
+	old := Config{"BUILD_SALT": `"abc"`, "X": "y", "GONE": "y"}
+	new := Config{"BUILD_SALT": `"def"`, "X": "m", "ADDED": "y"}
+	ignore := func(opt string) bool { return opt == "BUILD_SALT" }
+	got := DiffConfigIgnoringValues(old, new, ignore)
+	want := ConfigDiff{
+		InOld: []ConfigValue{
+			{Opt: "GONE", Val: "y"},
+		},
+		Changes: []ConfigChange{
+			{Opt: "X", OldVal: "y", NewVal: "m"},
+		},
+		InNew: []ConfigValue{
+			{Opt: "ADDED", Val: "y"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DiffConfigIgnoringValues(%#v, %#v) = %#v, want %#v",
+			old, new, got, want)
+	}
+}
+
 func symmetricChanges(oldnew, newold ConfigChange) bool {
 	equalopts := oldnew.Opt == newold.Opt
 	symmetricvals := oldnew.OldVal == newold.NewVal && oldnew.NewVal == newold.OldVal
@@ -408,3 +2199,274 @@ func testConfigDiffWriteToPredictableOrder(t *testing.T) {
 		}
 	}
 }
+
+func testConfigDiffWriteChangesOnly(t *testing.T) {
+	diff := ConfigDiff{
+		InOld: []ConfigValue{{Opt: "GONE", Val: "y"}},
+		Changes: []ConfigChange{
+			{Opt: "HZ", OldVal: "250", NewVal: "1000"},
+			{Opt: "EXT4_FS", OldVal: "m", NewVal: "y"},
+		},
+		InNew: []ConfigValue{{Opt: "ADDED", Val: "m"}},
+	}
+	want := " EXT4_FS m -> y\n HZ 250 -> 1000\n"
+	buf := new(bytes.Buffer)
+	n, err := diff.WriteChangesOnly(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("WriteChangesOnly wrote %q, want %q", got, want)
+	}
+	if n != int64(len(want)) {
+		t.Fatalf("WriteChangesOnly returned %d, want %d", n, len(want))
+	}
+	if diff.Changes[0].Opt != "HZ" {
+		t.Fatal("WriteChangesOnly reordered the diff")
+	}
+}
+
+func testConfigDiffWriteColored(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		if _, err := testConfigDiff.WriteColored(buf, false); err != nil {
+			t.Fatal(err)
+		}
+		want := "-FOO  4\n-FOO2 42\n BAR  n -> y\n Y    y -> t\n+BAZ  blah\n+BAZ2 blah2\n"
+		if got := buf.String(); got != want {
+			t.Fatalf("%#v.WriteColored(false) => %q, want %q", testConfigDiff, got, want)
+		}
+	})
+	t.Run("Color", func(t *testing.T) {
+		diff := ConfigDiff{
+			InOld:   []ConfigValue{{Opt: "A", Val: "y"}},
+			Changes: []ConfigChange{{Opt: "B", OldVal: "m", NewVal: "y"}},
+			InNew:   []ConfigValue{{Opt: "C", Val: "n"}},
+		}
+		buf := new(bytes.Buffer)
+		n, err := diff.WriteColored(buf, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "\x1b[31m-A y\x1b[0m\n\x1b[33m B m -> y\x1b[0m\n\x1b[32m+C n\x1b[0m\n"
+		if got := buf.String(); got != want {
+			t.Fatalf("%#v.WriteColored(true) => %q, want %q", diff, got, want)
+		}
+		if n != int64(len(want)) {
+			t.Fatalf("%#v.WriteColored(true) reported %d bytes, wrote %d", diff, n, len(want))
+		}
+	})
+}
+
+func testConfigDiffWriteGrouped(t *testing.T) {
+	diff := DiffConfig(
+		Config{"NET_IPV6": "y", "USB_STORAGE": "m", "USB_UAS": "m", "SMP": "y"},
+		Config{"NET_IPV6": "m", "NET_IPV4": "y", "USB_STORAGE": "y", "SMP": "y"},
+	)
+	buf := new(bytes.Buffer)
+	if _, err := diff.WriteGrouped(buf, "_"); err != nil {
+		t.Fatal(err)
+	}
+	want := "# NET\n NET_IPV6 y -> m\n+NET_IPV4 y\n\n# USB\n-USB_UAS m\n USB_STORAGE m -> y\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("%#v.WriteGrouped(%q) => %q, want %q", diff, "_", got, want)
+	}
+}
+
+func testConfigDiffPromotionsDemotions(t *testing.T) {
+	diff := ConfigDiff{
+		Changes: []ConfigChange{
+			{Opt: "A", OldVal: "n", NewVal: "m"},
+			{Opt: "B", OldVal: "m", NewVal: "n"},
+			{Opt: "C", OldVal: "m", NewVal: "y"},
+			{Opt: "D", OldVal: "y", NewVal: "n"},
+			{Opt: "E", OldVal: "32", NewVal: "64"},
+			{Opt: "F", OldVal: "n", NewVal: "y"},
+		},
+	}
+	wantPromotions := []ConfigChange{
+		{Opt: "A", OldVal: "n", NewVal: "m"},
+		{Opt: "C", OldVal: "m", NewVal: "y"},
+		{Opt: "F", OldVal: "n", NewVal: "y"},
+	}
+	if got := diff.Promotions(); !reflect.DeepEqual(got, wantPromotions) {
+		t.Fatalf("Promotions() = %v, want %v", got, wantPromotions)
+	}
+	wantDemotions := []ConfigChange{
+		{Opt: "B", OldVal: "m", NewVal: "n"},
+		{Opt: "D", OldVal: "y", NewVal: "n"},
+	}
+	if got := diff.Demotions(); !reflect.DeepEqual(got, wantDemotions) {
+		t.Fatalf("Demotions() = %v, want %v", got, wantDemotions)
+	}
+}
+
+func testConfigDiffSortTies(t *testing.T) {
+	diff := ConfigDiff{
+		InOld: []ConfigValue{
+			{Opt: "B", Val: "y"},
+			{Opt: "A", Val: "y"},
+			{Opt: "A", Val: "m"},
+		},
+		Changes: []ConfigChange{
+			{Opt: "X", OldVal: "y", NewVal: "n"},
+			{Opt: "X", OldVal: "m", NewVal: "y"},
+			{Opt: "X", OldVal: "m", NewVal: "n"},
+		},
+	}
+	diff.sort()
+	want := ConfigDiff{
+		InOld: []ConfigValue{
+			{Opt: "A", Val: "m"},
+			{Opt: "A", Val: "y"},
+			{Opt: "B", Val: "y"},
+		},
+		Changes: []ConfigChange{
+			{Opt: "X", OldVal: "m", NewVal: "n"},
+			{Opt: "X", OldVal: "m", NewVal: "y"},
+			{Opt: "X", OldVal: "y", NewVal: "n"},
+		},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("sort: got %#v, want %#v", diff, want)
+	}
+}
+
+func testConfigDiffNormalize(t *testing.T) {
+	old := Config{"GONE": "y", "UNSET": "n", "OFF": "m", "SAME": "y"}
+	cfg := Config{"OFF": "n", "SAME": "y", "ADDED": "m", "NEWLY_UNSET": "n"}
+	got := DiffConfig(old, cfg).Normalize()
+	want := ConfigDiff{
+		InOld:   []ConfigValue{{Opt: "GONE", Val: "y"}},
+		Changes: []ConfigChange{{Opt: "OFF", OldVal: "m", NewVal: "n"}},
+		InNew:   []ConfigValue{{Opt: "ADDED", Val: "m"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Normalize() = %#v, want %#v", got, want)
+	}
+
+	if diff := DiffConfig(Config{"X": "n"}, Config{}).Normalize(); !reflect.DeepEqual(diff, ConfigDiff{}) {
+		t.Errorf("disabled vs. absent: got %#v, want empty diff", diff)
+	}
+}
+
+func testConfigDiffSplit(t *testing.T) {
+	old := Config{"GONE": "y", "UP": "m", "DOWN": "y", "OFF": "m", "HZ": "250", "SAME": "y"}
+	cfg := Config{"UP": "y", "DOWN": "m", "OFF": "n", "HZ": "1000", "SAME": "y", "ADDED": "m"}
+	diff := DiffConfig(old, cfg)
+	additive, subtractive := diff.Split()
+
+	wantAdditive := ConfigDiff{
+		Changes: []ConfigChange{
+			{Opt: "HZ", OldVal: "250", NewVal: "1000"},
+			{Opt: "UP", OldVal: "m", NewVal: "y"},
+		},
+		InNew: []ConfigValue{{Opt: "ADDED", Val: "m"}},
+	}
+	wantSubtractive := ConfigDiff{
+		InOld: []ConfigValue{{Opt: "GONE", Val: "y"}},
+		Changes: []ConfigChange{
+			{Opt: "DOWN", OldVal: "y", NewVal: "m"},
+			{Opt: "OFF", OldVal: "m", NewVal: "n"},
+		},
+	}
+	if !reflect.DeepEqual(additive, wantAdditive) {
+		t.Errorf("additive = %#v, want %#v", additive, wantAdditive)
+	}
+	if !reflect.DeepEqual(subtractive, wantSubtractive) {
+		t.Errorf("subtractive = %#v, want %#v", subtractive, wantSubtractive)
+	}
+
+	staged, err := old.ApplyDiff(additive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, err = staged.ApplyDiff(subtractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !staged.Equal(cfg) {
+		t.Fatalf("applying both halves: got %#v, want %#v", staged, cfg)
+	}
+}
+
+func testConfigDiffPreconditions(t *testing.T) {
+	old := Config{"A": "y", "B": "m", "C": "n", "D": "64"}
+	cfg := Config{"B": "y", "C": "n", "D": "32", "E": "y"}
+	diff := DiffConfig(old, cfg)
+	got := diff.Preconditions()
+	want := []ConfigValue{
+		{Opt: "A", Val: "y"},
+		{Opt: "B", Val: "m"},
+		{Opt: "D", Val: "64"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Preconditions() = %v, want %v", got, want)
+	}
+
+	// A configuration which satisfies the preconditions accepts the diff.
+	satisfying := Config{"C": "y"}.Apply(got...)
+	if _, err := satisfying.ApplyDiff(diff); err != nil {
+		t.Fatalf("ApplyDiff on %#v, which satisfies the preconditions: %v", satisfying, err)
+	}
+}
+
+func testConfigDiffClassify(t *testing.T) {
+	old := Config{
+		"ENABLED":     "n",
+		"DISABLED":    "y",
+		"PROMOTED":    "m",
+		"DEMOTED":     "y",
+		"HZ":          "250",
+		"LOCALVER":    `"-a"`,
+		"GONE":        "m",
+		"GONE_STRING": `"x"`,
+	}
+	cfg := Config{
+		"ENABLED":   "m",
+		"DISABLED":  "n",
+		"PROMOTED":  "y",
+		"DEMOTED":   "m",
+		"HZ":        "1000",
+		"LOCALVER":  `"-b"`,
+		"ADDED":     "y",
+		"ADDED_OFF": "n",
+		"ADDED_HEX": "0x10",
+	}
+	got := DiffConfig(old, cfg).Classify()
+	want := map[string]ChangeClass{
+		"ENABLED":     FeatureEnabled,
+		"DISABLED":    FeatureDisabled,
+		"PROMOTED":    ModulePromoted,
+		"DEMOTED":     ModuleDemoted,
+		"HZ":          TunableChanged,
+		"LOCALVER":    StringChanged,
+		"GONE":        FeatureDisabled,
+		"GONE_STRING": StringChanged,
+		"ADDED":       FeatureEnabled,
+		"ADDED_OFF":   FeatureDisabled,
+		"ADDED_HEX":   TunableChanged,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Classify() = %v, want %v", got, want)
+	}
+	if got, want := ModulePromoted.String(), "ModulePromoted"; got != want {
+		t.Errorf("ModulePromoted.String() = %q, want %q", got, want)
+	}
+}
+
+func testConfigDiffTouchedOptions(t *testing.T) {
+	diff := ConfigDiff{
+		InOld:   []ConfigValue{{Opt: "OLD", Val: "y"}, {Opt: "DUP", Val: "y"}},
+		Changes: []ConfigChange{{Opt: "CHANGED", OldVal: "m", NewVal: "y"}},
+		InNew:   []ConfigValue{{Opt: "DUP", Val: "m"}, {Opt: "ADDED", Val: "y"}},
+	}
+	got := diff.TouchedOptions()
+	want := []string{"ADDED", "CHANGED", "DUP", "OLD"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("TouchedOptions() = %q, want %q", got, want)
+	}
+	if got := (ConfigDiff{}).TouchedOptions(); len(got) != 0 {
+		t.Fatalf("TouchedOptions() on empty diff = %q, want none", got)
+	}
+}
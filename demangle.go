@@ -0,0 +1,703 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Demangle returns a human readable form of the symbol's name. Rust symbols
+// mangled according to the v0 mangling scheme, whose names start with "_R",
+// are demangled, omitting crate disambiguators. For all other symbols, or
+// if demangling fails, Demangle returns the raw name, which is always
+// available in the Name field.
+func (sym Symbol) Demangle() string {
+	if s, ok := demangleRust(sym.Name); ok {
+		return s
+	}
+	return sym.Name
+}
+
+// demangleRust demangles a Rust v0 symbol name. The grammar is documented
+// at https://doc.rust-lang.org/rustc/symbol-mangling/v0.html.
+func demangleRust(name string) (string, bool) {
+	if !strings.HasPrefix(name, "_R") {
+		return "", false
+	}
+	d := &rustDemangler{s: name[len("_R"):]}
+	return d.demangle()
+}
+
+// maxRustDemangleDepth bounds the recursion depth of the demangler, which
+// could otherwise be exhausted by a malicious input.
+const maxRustDemangleDepth = 256
+
+// rustDemangler is a Rust v0 symbol demangler.
+type rustDemangler struct {
+	s   string // the symbol, without the leading "_R"
+	pos int    // current position in s
+
+	out   strings.Builder
+	quiet bool // if set, output is suppressed
+
+	depth          int // current recursion depth
+	boundLifetimes int // number of lifetimes bound by enclosing binders
+}
+
+// rustDemangleError is used to abort demangling, by way of panic.
+type rustDemangleError struct{}
+
+func (d *rustDemangler) demangle() (s string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isErr := r.(rustDemangleError); !isErr {
+				panic(r)
+			}
+			s, ok = "", false
+		}
+	}()
+
+	// An encoding version, if present, is a decimal number. Only the
+	// unversioned encoding exists so far.
+	if d.pos < len(d.s) && isDecimalDigit(d.s[d.pos]) {
+		d.fail()
+	}
+	d.path(true)
+
+	// The instantiating crate, if present, is parsed but not printed.
+	if d.pos < len(d.s) && !isVendorSuffix(d.s[d.pos]) {
+		quiet := d.quiet
+		d.quiet = true
+		d.path(false)
+		d.quiet = quiet
+	}
+
+	// Vendor specific suffixes, such as ".llvm.1234", are ignored.
+	if d.pos < len(d.s) && !isVendorSuffix(d.s[d.pos]) {
+		d.fail()
+	}
+	return d.out.String(), true
+}
+
+func isVendorSuffix(c byte) bool {
+	return c == '.' || c == '$'
+}
+
+func (d *rustDemangler) fail() {
+	panic(rustDemangleError{})
+}
+
+func (d *rustDemangler) print(s string) {
+	if !d.quiet {
+		d.out.WriteString(s)
+	}
+}
+
+func (d *rustDemangler) enter() {
+	d.depth++
+	if d.depth > maxRustDemangleDepth {
+		d.fail()
+	}
+}
+
+func (d *rustDemangler) leave() {
+	d.depth--
+}
+
+func (d *rustDemangler) peek() byte {
+	if d.pos >= len(d.s) {
+		d.fail()
+	}
+	return d.s[d.pos]
+}
+
+func (d *rustDemangler) next() byte {
+	c := d.peek()
+	d.pos++
+	return c
+}
+
+func (d *rustDemangler) eat(c byte) bool {
+	if d.pos < len(d.s) && d.s[d.pos] == c {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// path parses and prints a path. inValue indicates whether the path is in
+// value context, where generic arguments are introduced by "::<".
+func (d *rustDemangler) path(inValue bool) {
+	d.enter()
+	defer d.leave()
+
+	switch tag := d.next(); tag {
+	case 'C': // crate root
+		d.disambiguator()
+		d.print(d.ident())
+	case 'M': // inherent impl
+		d.implPath()
+		d.print("<")
+		d.typ()
+		d.print(">")
+	case 'X': // trait impl
+		d.implPath()
+		d.print("<")
+		d.typ()
+		d.print(" as ")
+		d.path(false)
+		d.print(">")
+	case 'Y': // trait definition
+		d.print("<")
+		d.typ()
+		d.print(" as ")
+		d.path(false)
+		d.print(">")
+	case 'N': // nested path
+		ns := d.next()
+		if !isLower(ns) && !isUpper(ns) {
+			d.fail()
+		}
+		d.path(inValue)
+		dis := d.disambiguator()
+		name := d.ident()
+		if isUpper(ns) {
+			// Special namespaces, such as closures.
+			d.print("::{")
+			switch ns {
+			case 'C':
+				d.print("closure")
+			case 'S':
+				d.print("shim")
+			default:
+				d.print(string(ns))
+			}
+			if name != "" {
+				d.print(":" + name)
+			}
+			d.print("#" + strconv.FormatUint(dis, 10) + "}")
+		} else if name != "" {
+			d.print("::" + name)
+		}
+	case 'I': // generic arguments
+		d.path(inValue)
+		if inValue {
+			d.print("::")
+		}
+		d.print("<")
+		for i := 0; !d.eat('E'); i++ {
+			if i > 0 {
+				d.print(", ")
+			}
+			d.genericArg()
+		}
+		d.print(">")
+	case 'B':
+		d.backref(func() { d.path(inValue) })
+	default:
+		d.fail()
+	}
+}
+
+// implPath parses the path of an impl block. It is not printed.
+func (d *rustDemangler) implPath() {
+	quiet := d.quiet
+	d.quiet = true
+	d.disambiguator()
+	d.path(false)
+	d.quiet = quiet
+}
+
+func (d *rustDemangler) genericArg() {
+	switch {
+	case d.eat('L'):
+		d.lifetime(d.base62())
+	case d.eat('K'):
+		d.constant()
+	default:
+		d.typ()
+	}
+}
+
+// basicRustTypes maps basic type tags to type names.
+var basicRustTypes = map[byte]string{
+	'a': "i8",
+	'b': "bool",
+	'c': "char",
+	'd': "f64",
+	'e': "str",
+	'f': "f32",
+	'h': "u8",
+	'i': "isize",
+	'j': "usize",
+	'l': "i32",
+	'm': "u32",
+	'n': "i128",
+	'o': "u128",
+	'p': "_",
+	's': "i16",
+	't': "u16",
+	'u': "()",
+	'v': "...",
+	'x': "i64",
+	'y': "u64",
+	'z': "!",
+}
+
+func (d *rustDemangler) typ() {
+	d.enter()
+	defer d.leave()
+
+	tag := d.next()
+	if name, ok := basicRustTypes[tag]; ok {
+		d.print(name)
+		return
+	}
+	switch tag {
+	case 'R', 'Q': // references
+		d.print("&")
+		if d.eat('L') {
+			if lt := d.base62(); lt != 0 {
+				d.lifetime(lt)
+				d.print(" ")
+			}
+		}
+		if tag == 'Q' {
+			d.print("mut ")
+		}
+		d.typ()
+	case 'P':
+		d.print("*const ")
+		d.typ()
+	case 'O':
+		d.print("*mut ")
+		d.typ()
+	case 'A': // array
+		d.print("[")
+		d.typ()
+		d.print("; ")
+		d.constant()
+		d.print("]")
+	case 'S': // slice
+		d.print("[")
+		d.typ()
+		d.print("]")
+	case 'T': // tuple
+		d.print("(")
+		n := 0
+		for ; !d.eat('E'); n++ {
+			if n > 0 {
+				d.print(", ")
+			}
+			d.typ()
+		}
+		if n == 1 {
+			d.print(",")
+		}
+		d.print(")")
+	case 'F':
+		d.fnSig()
+	case 'D':
+		d.dynBounds()
+		if !d.eat('L') {
+			d.fail()
+		}
+		if lt := d.base62(); lt != 0 {
+			d.print(" + ")
+			d.lifetime(lt)
+		}
+	case 'B':
+		d.backref(d.typ)
+	default:
+		d.pos--
+		d.path(false)
+	}
+}
+
+func (d *rustDemangler) fnSig() {
+	d.binder(func() {
+		if d.eat('U') {
+			d.print("unsafe ")
+		}
+		if d.eat('K') {
+			abi := "C"
+			if !d.eat('C') {
+				abi = strings.Replace(d.ident(), "_", "-", -1)
+			}
+			d.print(`extern "` + abi + `" `)
+		}
+		d.print("fn(")
+		for i := 0; !d.eat('E'); i++ {
+			if i > 0 {
+				d.print(", ")
+			}
+			d.typ()
+		}
+		d.print(")")
+		if d.eat('u') {
+			return // the unit return type is omitted
+		}
+		d.print(" -> ")
+		d.typ()
+	})
+}
+
+func (d *rustDemangler) dynBounds() {
+	d.binder(func() {
+		d.print("dyn ")
+		for i := 0; !d.eat('E'); i++ {
+			if i > 0 {
+				d.print(" + ")
+			}
+			d.dynTrait()
+		}
+	})
+}
+
+func (d *rustDemangler) dynTrait() {
+	open := d.dynTraitPath()
+	for d.eat('p') {
+		if open {
+			d.print(", ")
+		} else {
+			d.print("<")
+			open = true
+		}
+		d.print(d.ident() + " = ")
+		d.typ()
+	}
+	if open {
+		d.print(">")
+	}
+}
+
+// dynTraitPath parses and prints the path of a trait in a dyn type. If the
+// path has generic arguments, the closing ">" is not printed, so that
+// associated type bindings can follow, and dynTraitPath returns true.
+func (d *rustDemangler) dynTraitPath() (open bool) {
+	d.enter()
+	defer d.leave()
+
+	switch {
+	case d.eat('I'):
+		d.path(false)
+		d.print("<")
+		for i := 0; !d.eat('E'); i++ {
+			if i > 0 {
+				d.print(", ")
+			}
+			d.genericArg()
+		}
+		return true
+	case d.eat('B'):
+		d.backref(func() { open = d.dynTraitPath() })
+		return open
+	default:
+		d.path(false)
+		return false
+	}
+}
+
+// binder parses an optional binder of higher ranked lifetimes, prints it,
+// then calls f with the lifetimes in scope.
+func (d *rustDemangler) binder(f func()) {
+	var n int
+	if d.eat('G') {
+		n = int(d.base62()) + 1
+	}
+	if n > 0 {
+		d.print("for<")
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				d.print(", ")
+			}
+			d.boundLifetimes++
+			d.lifetime(1)
+		}
+		d.print("> ")
+	}
+	f()
+	d.boundLifetimes -= n
+}
+
+// lifetime prints the lifetime with the specified de Bruijn index.
+func (d *rustDemangler) lifetime(lt uint64) {
+	if lt == 0 {
+		d.print("'_")
+		return
+	}
+	if lt > uint64(d.boundLifetimes) {
+		d.fail()
+	}
+	depth := uint64(d.boundLifetimes) - lt
+	if depth < 26 {
+		d.print("'" + string(rune('a'+depth)))
+	} else {
+		d.print("'_" + strconv.FormatUint(depth, 10))
+	}
+}
+
+func (d *rustDemangler) constant() {
+	d.enter()
+	defer d.leave()
+
+	if d.eat('B') {
+		d.backref(d.constant)
+		return
+	}
+	if d.eat('p') {
+		d.print("_")
+		return
+	}
+	switch tag := d.next(); tag {
+	case 'a', 'h', 'i', 'j', 'l', 'm', 'n', 'o', 's', 't', 'x', 'y':
+		neg := d.eat('n')
+		hex := d.hexNibbles()
+		if neg {
+			d.print("-")
+		}
+		if v, err := strconv.ParseUint(hex, 16, 64); err == nil {
+			d.print(strconv.FormatUint(v, 10))
+		} else {
+			d.print("0x" + hex)
+		}
+	case 'b':
+		switch d.hexNibbles() {
+		case "0":
+			d.print("false")
+		case "1":
+			d.print("true")
+		default:
+			d.fail()
+		}
+	case 'c':
+		v, err := strconv.ParseUint(d.hexNibbles(), 16, 32)
+		if err != nil || !utf8.ValidRune(rune(v)) {
+			d.fail()
+		}
+		d.print(strconv.QuoteRune(rune(v)))
+	default:
+		d.fail()
+	}
+}
+
+// hexNibbles parses a sequence of lowercase hexadecimal digits terminated
+// by "_", and returns it without leading zeros.
+func (d *rustDemangler) hexNibbles() string {
+	start := d.pos
+	for !d.eat('_') {
+		c := d.next()
+		if !isDecimalDigit(c) && (c < 'a' || c > 'f') {
+			d.fail()
+		}
+	}
+	hex := strings.TrimLeft(d.s[start:d.pos-1], "0")
+	if hex == "" {
+		hex = "0"
+	}
+	return hex
+}
+
+// backref parses a back reference and calls f at the referenced position.
+func (d *rustDemangler) backref(f func()) {
+	start := d.pos - 1 // position of the 'B' tag
+	target := d.base62()
+	if target >= uint64(start) {
+		d.fail()
+	}
+	saved := d.pos
+	d.pos = int(target)
+	f()
+	d.pos = saved
+}
+
+// disambiguator parses an optional disambiguator, and returns its value.
+func (d *rustDemangler) disambiguator() uint64 {
+	if !d.eat('s') {
+		return 0
+	}
+	return d.base62() + 1
+}
+
+// base62 parses a base 62 number terminated by "_".
+func (d *rustDemangler) base62() uint64 {
+	if d.eat('_') {
+		return 0
+	}
+	var v uint64
+	for !d.eat('_') {
+		c := d.next()
+		var digit uint64
+		switch {
+		case isDecimalDigit(c):
+			digit = uint64(c - '0')
+		case isLower(c):
+			digit = uint64(c-'a') + 10
+		case isUpper(c):
+			digit = uint64(c-'A') + 36
+		default:
+			d.fail()
+		}
+		if v > (^uint64(0)-digit)/62 {
+			d.fail()
+		}
+		v = v*62 + digit
+	}
+	if v == ^uint64(0) {
+		d.fail()
+	}
+	return v + 1
+}
+
+// decimal parses a decimal number without leading zeros.
+func (d *rustDemangler) decimal() int {
+	c := d.next()
+	if !isDecimalDigit(c) {
+		d.fail()
+	}
+	if c == '0' {
+		return 0
+	}
+	v := int(c - '0')
+	for d.pos < len(d.s) && isDecimalDigit(d.s[d.pos]) {
+		v = v*10 + int(d.s[d.pos]-'0')
+		if v > len(d.s) {
+			d.fail()
+		}
+		d.pos++
+	}
+	return v
+}
+
+// ident parses an identifier, excluding its disambiguator, if any.
+func (d *rustDemangler) ident() string {
+	punycode := d.eat('u')
+	n := d.decimal()
+	d.eat('_')
+	if n > len(d.s)-d.pos {
+		d.fail()
+	}
+	ident := d.s[d.pos : d.pos+n]
+	d.pos += n
+	if punycode {
+		decoded, ok := decodeRustPunycode(ident)
+		if !ok {
+			d.fail()
+		}
+		return decoded
+	}
+	return ident
+}
+
+// decodeRustPunycode decodes a Punycode (RFC 3492) string, as encoded in
+// Rust v0 symbols, where "_" is used as the delimiter instead of "-".
+func decodeRustPunycode(s string) (string, bool) {
+	const (
+		base        = 36
+		tmin        = 1
+		tmax        = 26
+		skew        = 38
+		damp        = 700
+		initialBias = 72
+		initialN    = 128
+	)
+
+	var output []rune
+	if delim := strings.LastIndexByte(s, '_'); delim >= 0 {
+		for i := 0; i < delim; i++ {
+			if s[i] >= utf8.RuneSelf {
+				return "", false
+			}
+			output = append(output, rune(s[i]))
+		}
+		s = s[delim+1:]
+	}
+
+	adapt := func(delta, numPoints int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / numPoints
+		k := 0
+		for delta > ((base-tmin)*tmax)/2 {
+			delta /= base - tmin
+			k += base
+		}
+		return k + (base-tmin+1)*delta/(delta+skew)
+	}
+
+	n, i, bias := initialN, 0, initialBias
+	for len(s) > 0 {
+		oldi, w := i, 1
+		for k := base; ; k += base {
+			if len(s) == 0 {
+				return "", false
+			}
+			c := s[0]
+			s = s[1:]
+			var digit int
+			switch {
+			case isLower(c):
+				digit = int(c - 'a')
+			case isDecimalDigit(c):
+				digit = int(c-'0') + 26
+			default:
+				return "", false
+			}
+			if digit > (utf8.MaxRune-i)/w {
+				return "", false
+			}
+			i += digit * w
+			t := k - bias
+			if t < tmin {
+				t = tmin
+			} else if t > tmax {
+				t = tmax
+			}
+			if digit < t {
+				break
+			}
+			w *= base - t
+		}
+		numPoints := len(output) + 1
+		bias = adapt(i-oldi, numPoints, oldi == 0)
+		n += i / numPoints
+		i %= numPoints
+		if n > utf8.MaxRune || !utf8.ValidRune(rune(n)) {
+			return "", false
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), true
+}
+
+func isDecimalDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isLower(c byte) bool {
+	return 'a' <= c && c <= 'z'
+}
+
+func isUpper(c byte) bool {
+	return 'A' <= c && c <= 'Z'
+}
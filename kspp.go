@@ -0,0 +1,103 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"sort"
+	"strings"
+)
+
+// KSPPOptions lists the option values recommended by the Kernel Self
+// Protection Project, in the form "OPTION=value". The list covers the
+// architecture independent recommendations. It is consulted by KSPPReport,
+// and may be extended by callers before use.
+var KSPPOptions = []string{
+	// Report memory corruption early.
+	"BUG=y",
+	"BUG_ON_DATA_CORRUPTION=y",
+	"DEBUG_LIST=y",
+	"DEBUG_SG=y",
+	"DEBUG_NOTIFIERS=y",
+	"SCHED_STACK_END_CHECK=y",
+
+	// Enforce memory permissions.
+	"STRICT_KERNEL_RWX=y",
+	"STRICT_MODULE_RWX=y",
+	"VMAP_STACK=y",
+
+	// Harden the allocators and copies to and from user space.
+	"HARDENED_USERCOPY=y",
+	"FORTIFY_SOURCE=y",
+	"SLAB_FREELIST_RANDOM=y",
+	"SLAB_FREELIST_HARDENED=y",
+	"SHUFFLE_PAGE_ALLOCATOR=y",
+	"INIT_ON_ALLOC_DEFAULT_ON=y",
+
+	// Stack protection and address space randomization.
+	"STACKPROTECTOR=y",
+	"STACKPROTECTOR_STRONG=y",
+	"RANDOMIZE_BASE=y",
+
+	// Restrict access to kernel information and attack surface.
+	"SECCOMP=y",
+	"SECCOMP_FILTER=y",
+	"SECURITY_DMESG_RESTRICT=y",
+	"SECURITY_YAMA=y",
+
+	// Disable interfaces which expose kernel memory, or are rarely
+	// needed and frequently exploited.
+	"DEVMEM=n",
+	"DEVKMEM=n",
+	"PROC_KCORE=n",
+	"COMPAT_BRK=n",
+	"LEGACY_PTYS=n",
+	"HIBERNATION=n",
+	"KEXEC=n",
+	"BINFMT_MISC=n",
+	"INET_DIAG=n",
+	"ACPI_CUSTOM_METHOD=n",
+	"USELIB=n",
+	"MODIFY_LDT_SYSCALL=n",
+}
+
+// KSPPReport checks cfg against the recommendations in KSPPOptions, and
+// returns the deviations, sorted by option name. In each ConfigChange,
+// OldVal is the value in cfg, or the empty string if the option is not
+// present, and NewVal is the recommended value. An option which is not
+// present satisfies a recommended value of n, since that is how disabled
+// options are treated by Kconfig.
+func (cfg Config) KSPPReport() []ConfigChange {
+	var deviations []ConfigChange
+	for _, rec := range KSPPOptions {
+		eq := strings.Index(rec, "=")
+		if eq < 0 {
+			continue
+		}
+		opt, want := rec[:eq], rec[eq+1:]
+		val, ok := cfg[opt]
+		if val == want || (!ok && want == "n") {
+			continue
+		}
+		deviations = append(deviations, ConfigChange{
+			Opt:    opt,
+			OldVal: val,
+			NewVal: want,
+		})
+	}
+	sort.Slice(deviations, func(i, j int) bool {
+		return deviations[i].less(deviations[j])
+	})
+	return deviations
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Module describes a loaded kernel module, as listed in /proc/modules.
+type Module struct {
+	// Name is the name of the module, as it appears in the module field
+	// of symbols which belong to it.
+	Name string
+
+	// Size is the size of the module in memory, in bytes.
+	Size uintptr
+
+	// Base is the address at which the module is loaded. It is zero if
+	// the kernel hides addresses from the reader, as per the
+	// kernel.kptr_restrict sysctl.
+	Base uintptr
+
+	// RefCount is the number of references to the module.
+	RefCount int
+
+	// UsedBy lists the modules which depend on the module.
+	UsedBy []string
+
+	// State is the state of the module: Live, Loading or Unloading.
+	State string
+}
+
+// Modules calls ParseModulesFile("/proc/modules").
+func Modules() ([]Module, error) {
+	return ParseModulesFile("/proc/modules")
+}
+
+// ParseModulesFile reads the list of loaded modules from the specified path.
+// The path should indicate /proc/modules or the equivalent file if procfs
+// is mounted elsewhere.
+func ParseModulesFile(path string) ([]Module, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseModules(f)
+}
+
+// ParseModules reads the list of loaded modules from r, until EOF. The input
+// must be in the format of /proc/modules. Modules are returned in the order
+// in which they appear in the input.
+func ParseModules(r io.Reader) ([]Module, error) {
+	var mods []Module
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		mod, err := parseModule(line)
+		if err != nil {
+			return nil, xerrors.Errorf("linuxkernel: malformed module line %q: %w", line, err)
+		}
+		mods = append(mods, mod)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return mods, nil
+}
+
+// parseModule parses a line of the form
+//
+//	nf_nat 49152 1 nf_conntrack_netlink, Live 0xffffffffc0a1b000 (E)
+//
+// where the fields are the name, size, reference count, users, state
+// and base address, followed by optional taint flags.
+func parseModule(line string) (Module, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 {
+		return Module{}, xerrors.Errorf("got %d fields, want at least 6", len(fields))
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return Module{}, xerrors.Errorf("failed to parse size: %w", err)
+	}
+	refcount, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Module{}, xerrors.Errorf("failed to parse reference count: %w", err)
+	}
+	var usedBy []string
+	if fields[3] != "-" {
+		for _, user := range strings.Split(fields[3], ",") {
+			if user != "" {
+				usedBy = append(usedBy, user)
+			}
+		}
+	}
+	base, err := strconv.ParseUint(strings.TrimPrefix(fields[5], "0x"), 16, 64)
+	if err != nil {
+		return Module{}, xerrors.Errorf("failed to parse base address: %w", err)
+	}
+	return Module{
+		Name:     fields[0],
+		Size:     uintptr(size),
+		Base:     uintptr(base),
+		RefCount: refcount,
+		UsedBy:   usedBy,
+		State:    fields[4],
+	}, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ParseObjdumpSymbols reads the output of objdump -d from r, until EOF,
+// and builds a SymbolTable from the symbol headers it contains, i.e. lines
+// such as
+//
+//	ffffffff81000000 <startup_64>:
+//
+// All other lines, such as instructions and section headers, are ignored.
+// The resulting table is only as complete as the disassembly: data symbols,
+// for example, are usually missing.
+//
+// Objdump headers do not carry nm-style symbol types, so the type of every
+// symbol in the table is SymbolTypeUnknown. Neither do they carry module
+// names, so every symbol is reported as built in.
+func ParseObjdumpSymbols(r io.Reader) (SymbolTable, error) {
+	symtab := make(SymbolTable)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		sym, ok, err := parseObjdumpHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			symtab[sym] = struct{}{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return symtab, nil
+}
+
+// ParseObjdumpSymbolsWithSources is like ParseObjdumpSymbols, but it also
+// records SourceObjdump as the source of each symbol it reads, in sources.
+// If ParseObjdumpSymbolsWithSources returns an error, sources is left
+// unchanged.
+func ParseObjdumpSymbolsWithSources(r io.Reader, sources SymbolSources) (SymbolTable, error) {
+	symtab, err := ParseObjdumpSymbols(r)
+	if err != nil {
+		return nil, err
+	}
+	sources.Add(symtab, SourceObjdump)
+	return symtab, nil
+}
+
+// parseObjdumpHeader parses a symbol header line from the output of
+// objdump -d. If line is not a symbol header, it returns ok == false.
+func parseObjdumpHeader(line string) (sym Symbol, ok bool, err error) {
+	line = strings.TrimRight(line, " \t")
+	if !strings.HasSuffix(line, ">:") {
+		return Symbol{}, false, nil
+	}
+	i := strings.Index(line, " <")
+	if i <= 0 || !isHexDigits(line[:i]) {
+		return Symbol{}, false, nil
+	}
+	addr, err := strconv.ParseUint(line[:i], 16, 64)
+	if err != nil {
+		return Symbol{}, false, malformedSymbolError{
+			Line: line,
+			Err:  xerrors.Errorf("failed to parse symbol address: %w", err),
+		}
+	}
+	name := line[i+len(" <") : len(line)-len(">:")]
+	if name == "" {
+		return Symbol{}, false, malformedSymbolError{
+			Line: line,
+			Err:  xerrors.New("empty symbol name"),
+		}
+	}
+	sym = Symbol{
+		Addr: uintptr(addr),
+		Type: SymbolTypeUnknown,
+		Name: name,
+	}
+	return sym, true, nil
+}
+
+// isHexDigits returns a boolean indicating whether s consists solely of
+// hexadecimal digits.
+func isHexDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
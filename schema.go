@@ -0,0 +1,234 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ValueKind is the kind of the value of a configuration option, mirroring
+// the Kconfig types.
+type ValueKind int
+
+// Value kinds.
+const (
+	KindTristate ValueKind = iota // n, m or y
+	KindInt                       // a decimal integer, e.g. 64
+	KindHex                       // a hexadecimal integer, e.g. 0x1000
+	KindString                    // a quoted string, e.g. "foo"
+	KindEmpty                     // an empty value, as in CONFIG_FOO=
+)
+
+func (kind ValueKind) String() string {
+	switch kind {
+	case KindTristate:
+		return "tristate"
+	case KindInt:
+		return "int"
+	case KindHex:
+		return "hex"
+	case KindString:
+		return "string"
+	case KindEmpty:
+		return "empty"
+	default:
+		return fmt.Sprintf("ValueKind(%d)", int(kind))
+	}
+}
+
+// matches returns a boolean indicating whether val is a well-formed value
+// of the specified kind.
+func (kind ValueKind) matches(val string) bool {
+	switch kind {
+	case KindTristate:
+		_, ok := ParseTristate(val)
+		return ok
+	case KindInt:
+		_, err := strconv.ParseInt(val, 10, 64)
+		return err == nil
+	case KindHex:
+		if !strings.HasPrefix(val, "0x") && !strings.HasPrefix(val, "0X") {
+			return false
+		}
+		_, err := strconv.ParseUint(val[2:], 16, 64)
+		return err == nil
+	case KindString:
+		_, err := UnquoteValue(val)
+		return err == nil
+	case KindEmpty:
+		return val == ""
+	default:
+		return false
+	}
+}
+
+// classifyOrder is the order in which ClassifyValue tries value kinds.
+var classifyOrder = []ValueKind{KindEmpty, KindTristate, KindHex, KindInt, KindString}
+
+// ClassifyValue determines the kind of a configuration value, by trying
+// each kind in turn: KindEmpty for the empty Go string, KindTristate for
+// n, m and y, KindHex for integers with a 0x prefix, KindInt for decimal
+// integers, and KindString for quoted strings, including the quoted empty
+// string `""`. These are the same rules ValidateSchema applies. The boolean
+// ok is false if val is not of any kind, e.g. if it is an unquoted word.
+func ClassifyValue(val string) (kind ValueKind, ok bool) {
+	for _, kind := range classifyOrder {
+		if kind.matches(val) {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// TypeChanges returns the Changes in the diff for which the old and the new
+// values are of different kinds, as determined by ClassifyValue, e.g. a
+// tristate option which became an integer. Such changes often indicate a
+// semantic change in Kconfig, rather than a simple edit of the value.
+// A value which is not of any kind is considered different from a value
+// which is.
+func (diff ConfigDiff) TypeChanges() []ConfigChange {
+	var changes []ConfigChange
+	for _, cc := range diff.Changes {
+		oldkind, oldok := ClassifyValue(cc.OldVal)
+		newkind, newok := ClassifyValue(cc.NewVal)
+		if oldok != newok || oldkind != newkind {
+			changes = append(changes, cc)
+		}
+	}
+	return changes
+}
+
+// SelectByType returns the options in cfg whose values are of the specified
+// kind, as determined by ClassifyValue, sorted by option name.
+func (cfg Config) SelectByType(kind ValueKind) []ConfigValue {
+	var selected []ConfigValue
+	for _, opt := range cfg.sortedOptions() {
+		val := cfg[opt]
+		if k, ok := ClassifyValue(val); ok && k == kind {
+			selected = append(selected, ConfigValue{Opt: opt, Val: val})
+		}
+	}
+	return selected
+}
+
+// ValueSpec specifies the acceptable values for a configuration option.
+type ValueSpec struct {
+	// Kind is the kind of the value.
+	Kind ValueKind
+
+	// Allowed, if not empty, lists the acceptable values, as they would
+	// appear in a Config. For example, string values must be quoted.
+	Allowed []string
+}
+
+// ConfigSchema maps option names to specifications for their values.
+type ConfigSchema map[string]ValueSpec
+
+// ValidateSchema checks the options in cfg against the specified schema,
+// and returns an error for each option whose value does not conform to its
+// specification, sorted by option name. Options not in the schema, and
+// options in the schema but not in cfg, are ignored.
+func (cfg Config) ValidateSchema(schema ConfigSchema) []error {
+	var errs []error
+	for _, opt := range cfg.sortedOptions() {
+		spec, ok := schema[opt]
+		if !ok {
+			continue
+		}
+		if err := spec.validate(opt, cfg[opt]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// CheckDeps checks the enabled options in cfg against a set of declared
+// dependencies, where deps maps an option to the options it requires. An
+// option is enabled if its value is y or m. CheckDeps returns an error for
+// each enabled option which requires options which are not enabled, sorted
+// by option name. This is a much simpler model than the one used by Kconfig,
+// but it catches common mistakes made when editing configurations by hand.
+func (cfg Config) CheckDeps(deps map[string][]string) []error {
+	opts := make([]string, 0, len(deps))
+	for opt := range deps {
+		opts = append(opts, opt)
+	}
+	sort.Strings(opts)
+
+	var errs []error
+	for _, opt := range opts {
+		if !cfg.IsEnabled(opt) {
+			continue
+		}
+		var missing []string
+		for _, dep := range deps[opt] {
+			if !cfg.IsEnabled(dep) {
+				missing = append(missing, dep)
+			}
+		}
+		if len(missing) > 0 {
+			errs = append(errs, xerrors.Errorf("linuxkernel: %s=%s: requires %s, which is not enabled",
+				opt, cfg[opt], strings.Join(missing, ", ")))
+		}
+	}
+	return errs
+}
+
+// EnableWithDeps returns a copy of cfg in which opt is set to y, along with
+// the options it requires, recursively, according to deps, which has the
+// same meaning as for CheckDeps. This approximates what the kernel
+// configuration tools do when an option is selected. Since a built-in
+// option cannot depend on a module, required options are set to y even if
+// they are already set to m. Cyclic dependencies are allowed: each option
+// is visited at most once.
+func (cfg Config) EnableWithDeps(opt string, deps map[string][]string) Config {
+	enabled := cfg.clone()
+	visited := make(map[string]bool)
+	var enable func(opt string)
+	enable = func(opt string) {
+		if visited[opt] {
+			return
+		}
+		visited[opt] = true
+		enabled[opt] = "y"
+		for _, dep := range deps[opt] {
+			enable(dep)
+		}
+	}
+	enable(opt)
+	return enabled
+}
+
+func (spec ValueSpec) validate(opt, val string) error {
+	if !spec.Kind.matches(val) {
+		return xerrors.Errorf("linuxkernel: %s=%s: not a valid %v value", opt, val, spec.Kind)
+	}
+	if len(spec.Allowed) == 0 {
+		return nil
+	}
+	for _, allowed := range spec.Allowed {
+		if val == allowed {
+			return nil
+		}
+	}
+	allowed := append([]string(nil), spec.Allowed...)
+	sort.Strings(allowed)
+	return xerrors.Errorf("linuxkernel: %s=%s: value not one of %s", opt, val, strings.Join(allowed, ", "))
+}
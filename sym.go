@@ -17,9 +17,12 @@ package linuxkernel
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 
 	"golang.org/x/xerrors"
@@ -31,70 +34,329 @@ type Symbol struct {
 	Type   SymbolType
 	Name   string
 	Module string
+
+	// Extra holds the optional fifth field of a symbol table line, which
+	// follows the module field, verbatim. Standard /proc/kallsyms output
+	// never includes such a field, but some tools which produce
+	// kallsyms-formatted output append one, e.g. to record how the
+	// address was encoded. The package does not attempt to interpret it,
+	// and only writes it back out. Since the field is only recognized
+	// after a module field, it is always empty for built-in symbols:
+	// a line such as "ffffffff81000000 T name extra" is malformed.
+	Extra string
 }
 
+// Well known symbol sources, for use with SymbolSources.
+const (
+	SourceKallsyms  = "kallsyms"
+	SourceSystemMap = "systemmap"
+	SourceELF       = "elf"
+	SourceNM        = "nm"
+	SourceObjdump   = "objdump"
+)
+
 func (sym Symbol) String() string {
-	s := fmt.Sprintf("%016x %c %s", sym.Addr, sym.Type, sym.Name)
+	s := fmt.Sprintf("%s %c %s", sym.AddrString(), sym.Type, sym.Name)
 	if sym.Module != "" {
 		s += fmt.Sprintf(" [%s]", sym.Module)
 	}
+	if sym.Extra != "" {
+		s += " " + sym.Extra
+	}
 	return s
 }
 
+// AddrString formats the address of the symbol as 16 hexadecimal digits,
+// as in /proc/kallsyms, and as in the output of String.
+func (sym Symbol) AddrString() string {
+	return fmt.Sprintf("%016x", sym.Addr)
+}
+
+// IsModule returns a boolean indicating whether the symbol belongs to a
+// loadable module.
+func (sym Symbol) IsModule() bool {
+	return sym.Module != ""
+}
+
+// IsBuiltin returns a boolean indicating whether the symbol is built into
+// the kernel image, as opposed to belonging to a loadable module.
+func (sym Symbol) IsBuiltin() bool {
+	return !sym.IsModule()
+}
+
 // SymbolType is the type of a symbol, as reported by nm and /proc/kallsyms.
 type SymbolType rune
 
+// Common symbol types. By convention, an upper case letter denotes a global
+// symbol, while the corresponding lower case letter denotes a local one.
+// For weak symbols and objects, the lower case letter instead means that
+// no default value has been specified. Unique global symbols ('u') are
+// an exception: they are global, and have no local counterpart.
+const (
+	SymbolTypeAbsolute      SymbolType = 'A'
+	SymbolTypeAbsoluteLocal SymbolType = 'a'
+
+	SymbolTypeBSS      SymbolType = 'B'
+	SymbolTypeBSSLocal SymbolType = 'b'
+
+	SymbolTypeData      SymbolType = 'D'
+	SymbolTypeDataLocal SymbolType = 'd'
+
+	SymbolTypeReadonly      SymbolType = 'R'
+	SymbolTypeReadonlyLocal SymbolType = 'r'
+
+	SymbolTypeText      SymbolType = 'T'
+	SymbolTypeTextLocal SymbolType = 't'
+
+	SymbolTypeWeakObject          SymbolType = 'V'
+	SymbolTypeWeakObjectNoDefault SymbolType = 'v'
+
+	SymbolTypeWeakSymbol          SymbolType = 'W'
+	SymbolTypeWeakSymbolNoDefault SymbolType = 'w'
+
+	SymbolTypeIndirect      SymbolType = 'I'
+	SymbolTypeIndirectLocal SymbolType = 'i'
+
+	SymbolTypeUndefined    SymbolType = 'U'
+	SymbolTypeUniqueGlobal SymbolType = 'u'
+
+	SymbolTypeUnknown SymbolType = '?'
+)
+
 // Absolute returns a boolean indicating whether the symbol's value is
 // absolute, and will not be changed by further linking ('A' or 'a').
 func (styp SymbolType) Absolute() bool {
 	// TODO(acln): is this correct? What is 'a', exactly?
-	return styp == 'A' || styp == 'a'
+	return styp == SymbolTypeAbsolute || styp == SymbolTypeAbsoluteLocal
 }
 
 // BSS returns a boolean indicating whether the symbol is in the BSS data
 // section ('B' or 'b').
 func (styp SymbolType) BSS() bool {
-	return styp == 'B' || styp == 'b'
+	return styp == SymbolTypeBSS || styp == SymbolTypeBSSLocal
 }
 
 // Data returns a boolean indicating whether the symbol is in the initialized
 // data section ('D' or 'd').
 func (styp SymbolType) Data() bool {
-	return styp == 'D' || styp == 'd'
+	return styp == SymbolTypeData || styp == SymbolTypeDataLocal
 }
 
 // Readonly returns a boolean indicating whether the symbol is in a read only
 // data section ('R' or 'r').
 func (styp SymbolType) Readonly() bool {
-	return styp == 'R' || styp == 'r'
+	return styp == SymbolTypeReadonly || styp == SymbolTypeReadonlyLocal
 }
 
 // Text returns a boolean indicating whether the symbol is in a text section
 // ('T' or 't').
 func (styp SymbolType) Text() bool {
-	return styp == 'T' || styp == 't'
+	return styp == SymbolTypeText || styp == SymbolTypeTextLocal
 }
 
 // WeakObject returns a boolean indicating whether the symbol is a weak object
 // ('V' or 'v').
 func (styp SymbolType) WeakObject() bool {
-	return styp == 'V' || styp == 'v'
+	return styp == SymbolTypeWeakObject || styp == SymbolTypeWeakObjectNoDefault
 }
 
 // WeakSymbol returns a boolean indicating whether the symbol is a weak symbol
 // ('W' or 'w').
 func (styp SymbolType) WeakSymbol() bool {
-	return styp == 'W' || styp == 'w'
+	return styp == SymbolTypeWeakSymbol || styp == SymbolTypeWeakSymbolNoDefault
+}
+
+// Indirect returns a boolean indicating whether the symbol is an indirect
+// function, i.e. a GNU IFUNC symbol ('I' or 'i').
+func (styp SymbolType) Indirect() bool {
+	return styp == SymbolTypeIndirect || styp == SymbolTypeIndirectLocal
 }
 
 // Global returns a boolean indicating whether the symbol is global (external).
+// Unique global symbols ('u') are global, despite their lower case letter.
 func (styp SymbolType) Global() bool {
-	return unicode.IsUpper(rune(styp))
+	return styp == SymbolTypeUniqueGlobal || unicode.IsUpper(rune(styp))
 }
 
 // SymbolTable is a Linux kernel symbol table.
+//
+// Like any map, a SymbolTable may be read by multiple goroutines at once,
+// but not while it is being modified. Methods which look up symbols by
+// address, such as Resolve and Around, build a sorted index of the table
+// on every call, rather than caching it. To share a table between
+// goroutines which resolve many addresses, use ConcurrentSymbolTable.
 type SymbolTable map[Symbol]struct{}
 
+var _ io.WriterTo = SymbolTable(nil)
+
+// SymbolSources records where symbols came from, e.g. one of the Source*
+// constants, for symbol tables merged from several sources. It is kept
+// apart from the symbols themselves, so that a symbol reported by several
+// sources appears only once in the merged table, with all its sources
+// recorded here. ReadSymbolsWithSources and ParseObjdumpSymbolsWithSources
+// record sources as they parse. Use Add for tables obtained otherwise.
+type SymbolSources map[Symbol][]string
+
+// Add records source as a source of every symbol in symtab. Sources are
+// recorded in the order in which they are added, and at most once per
+// symbol. For example, to merge two tables, and track where each symbol
+// came from:
+//
+//	merged := make(SymbolTable)
+//	sources := make(SymbolSources)
+//	for source, symtab := range map[string]SymbolTable{
+//		SourceKallsyms:  kallsyms,
+//		SourceSystemMap: systemMap,
+//	} {
+//		for sym := range symtab {
+//			merged[sym] = struct{}{}
+//		}
+//		sources.Add(symtab, source)
+//	}
+func (sources SymbolSources) Add(symtab SymbolTable, source string) {
+	for sym := range symtab {
+		if !sources.has(sym, source) {
+			sources[sym] = append(sources[sym], source)
+		}
+	}
+}
+
+func (sources SymbolSources) has(sym Symbol, source string) bool {
+	for _, s := range sources[sym] {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// WithKASLROffset returns a copy of symtab in which slide is added to the
+// address of every built-in symbol. This is useful for resolving addresses
+// from a running kernel with kernel address space layout randomization
+// (KASLR) enabled against an offline symbol table, such as System.map.
+// Module symbols are left alone, since modules are randomized
+// independently, and so are absolute symbols, whose values are not
+// addresses.
+//
+// The slide is the difference between the runtime address of a reference
+// symbol, e.g. _stext as reported by /proc/kallsyms, and its address in the
+// offline table. Since addresses wrap around, a negative slide can be
+// expressed as the difference computed in uintptr arithmetic.
+func (symtab SymbolTable) WithKASLROffset(slide uintptr) SymbolTable {
+	slid := make(SymbolTable, len(symtab))
+	for sym := range symtab {
+		if sym.IsBuiltin() && !sym.Type.Absolute() {
+			sym.Addr += slide
+		}
+		slid[sym] = struct{}{}
+	}
+	return slid
+}
+
+// MapNames returns a copy of symtab in which the Name field of each symbol
+// is replaced by f(sym). This is useful for disambiguating symbols from
+// several versions of the same module, e.g. by prefixing their names. If f
+// maps two distinct symbols to the same symbol, the returned table has
+// only one copy of it.
+func (symtab SymbolTable) MapNames(f func(Symbol) string) SymbolTable {
+	mapped := make(SymbolTable, len(symtab))
+	for sym := range symtab {
+		sym.Name = f(sym)
+		mapped[sym] = struct{}{}
+	}
+	return mapped
+}
+
+// ModuleRange returns the lowest and highest addresses of the symbols which
+// belong to the specified module, which approximate the extent of the module
+// in memory. Since hi is the address of the last symbol rather than its end,
+// the true extent of the module is slightly larger. If the module has no
+// symbols in symtab, ok is false.
+func (symtab SymbolTable) ModuleRange(module string) (lo, hi uintptr, ok bool) {
+	for sym := range symtab {
+		if sym.Module != module {
+			continue
+		}
+		if !ok || sym.Addr < lo {
+			lo = sym.Addr
+		}
+		if !ok || sym.Addr > hi {
+			hi = sym.Addr
+		}
+		ok = true
+	}
+	return lo, hi, ok
+}
+
+// DefaultBucketSize is the bucket size used by AddressHistogram when the
+// requested bucket size is zero. It is the size of a page on most
+// architectures.
+const DefaultBucketSize = 4096
+
+// AddressHistogram divides the address space into buckets of the specified
+// size, and counts the symbols in each bucket. The returned map is keyed by
+// the base address of each bucket, i.e. the address of a symbol rounded
+// down to a multiple of bucketSize. Empty buckets are omitted. If bucketSize
+// is zero, DefaultBucketSize is used.
+func (symtab SymbolTable) AddressHistogram(bucketSize uintptr) map[uintptr]int {
+	if bucketSize == 0 {
+		bucketSize = DefaultBucketSize
+	}
+	hist := make(map[uintptr]int)
+	for sym := range symtab {
+		hist[sym.Addr-sym.Addr%bucketSize]++
+	}
+	return hist
+}
+
+// FilterAddr returns the symbols whose addresses satisfy pred, sorted by
+// address, then by name. For example, to find page aligned symbols:
+//
+//	symtab.FilterAddr(func(addr uintptr) bool {
+//		return addr%4096 == 0
+//	})
+func (symtab SymbolTable) FilterAddr(pred func(uintptr) bool) []Symbol {
+	var syms []Symbol
+	for sym := range symtab {
+		if pred(sym.Addr) {
+			syms = append(syms, sym)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		return syms[i].less(syms[j])
+	})
+	return syms
+}
+
+// BySection groups the symbols in symtab by the broad section of the kernel
+// image they belong to, as indicated by their type: "text", "data", "bss",
+// "rodata", or "other" for any other type. Only non-empty groups are
+// present in the returned map. Each group is sorted by address, then by
+// name.
+func (symtab SymbolTable) BySection() map[string][]Symbol {
+	sections := make(map[string][]Symbol)
+	for sym := range symtab {
+		section := "other"
+		switch {
+		case sym.Type.Text():
+			section = "text"
+		case sym.Type.Data():
+			section = "data"
+		case sym.Type.BSS():
+			section = "bss"
+		case sym.Type.Readonly():
+			section = "rodata"
+		}
+		sections[section] = append(sections[section], sym)
+	}
+	for _, syms := range sections {
+		sort.Slice(syms, func(i, j int) bool {
+			return syms[i].less(syms[j])
+		})
+	}
+	return sections
+}
+
 // Find finds symbols with the specified name.
 func (symtab SymbolTable) Find(name string) []Symbol {
 	var syms []Symbol
@@ -108,36 +370,546 @@ func (symtab SymbolTable) Find(name string) []Symbol {
 	return syms
 }
 
+// FindIn finds the symbol with the specified name in the specified module.
+// An empty module name denotes the kernel itself, i.e. built-in symbols.
+// If several such symbols exist, such as static functions of the same name
+// in different compilation units, the one which sorts first, by address,
+// is returned. If there are none, ok is false.
+func (symtab SymbolTable) FindIn(module, name string) (sym Symbol, ok bool) {
+	for candidate := range symtab {
+		if candidate.Name != name || candidate.Module != module {
+			continue
+		}
+		if !ok || candidate.less(sym) {
+			sym = candidate
+			ok = true
+		}
+	}
+	return sym, ok
+}
+
+// Resolve finds the symbol containing addr, i.e. the symbol with the
+// highest address less than or equal to addr, and returns it, along with
+// the offset of addr from the start of the symbol. If several symbols
+// share that address, the first one by name is returned. If there is no
+// such symbol, ok is false.
+//
+// Resolve sorts the symbol table each time it is called. Callers which
+// resolve many addresses should consider using ConcurrentSymbolTable
+// or LiveSymbols.
+func (symtab SymbolTable) Resolve(addr uintptr) (sym Symbol, offset uintptr, ok bool) {
+	return newSymbolIndex(symtab).resolve(addr)
+}
+
+// ResolveExact is like Resolve, but it also reports whether addr is exactly
+// at the start of the symbol, i.e. whether the offset is zero. This is
+// useful for telling function entry points, e.g. call targets, apart from
+// addresses in the middle of functions, e.g. return addresses.
+func (symtab SymbolTable) ResolveExact(addr uintptr) (sym Symbol, atStart bool, offset uintptr, ok bool) {
+	sym, offset, ok = symtab.Resolve(addr)
+	return sym, ok && offset == 0, offset, ok
+}
+
+// ResolveString parses hexAddr as a hexadecimal address, with or without
+// a 0x prefix, resolves it as Resolve does, and formats the result as
+// "name+0xoffset", followed by " [module]" for module symbols, e.g.
+// "nf_conntrack_in+0x50 [nf_conntrack]". It returns an error if hexAddr
+// is not a valid address, or if no symbol contains it.
+func (symtab SymbolTable) ResolveString(hexAddr string) (string, error) {
+	digits := hexAddr
+	if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+		digits = digits[2:]
+	}
+	addr, err := strconv.ParseUint(digits, 16, 64)
+	if err != nil {
+		return "", xerrors.Errorf("linuxkernel: invalid address %q: %w", hexAddr, err)
+	}
+	sym, offset, ok := symtab.Resolve(uintptr(addr))
+	if !ok {
+		return "", xerrors.Errorf("linuxkernel: no symbol contains address %#x", addr)
+	}
+	s := fmt.Sprintf("%s+%#x", sym.Name, offset)
+	if sym.Module != "" {
+		s += fmt.Sprintf(" [%s]", sym.Module)
+	}
+	return s, nil
+}
+
+// Around returns up to k symbols closest to addr, sorted by their distance
+// from addr, and then by address.
+func (symtab SymbolTable) Around(addr uintptr, k int) []Symbol {
+	return newSymbolIndex(symtab).around(addr, k)
+}
+
+// symbolIndex is a list of symbols sorted by address. Symbols with the same
+// address are sorted by name, then by module, then by type.
+type symbolIndex []Symbol
+
+func newSymbolIndex(symtab SymbolTable) symbolIndex {
+	idx := make(symbolIndex, 0, len(symtab))
+	for sym := range symtab {
+		idx = append(idx, sym)
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return idx[i].less(idx[j])
+	})
+	return idx
+}
+
+// less reports whether sym sorts before other in a symbolIndex.
+func (sym Symbol) less(other Symbol) bool {
+	if sym.Addr != other.Addr {
+		return sym.Addr < other.Addr
+	}
+	if sym.Name != other.Name {
+		return sym.Name < other.Name
+	}
+	if sym.Module != other.Module {
+		return sym.Module < other.Module
+	}
+	return sym.Type < other.Type
+}
+
+// search returns the index of the first symbol whose address is greater
+// than or equal to addr.
+func (idx symbolIndex) search(addr uintptr) int {
+	return sort.Search(len(idx), func(i int) bool {
+		return idx[i].Addr >= addr
+	})
+}
+
+func (idx symbolIndex) resolve(addr uintptr) (sym Symbol, offset uintptr, ok bool) {
+	// Find the last symbol with an address less than or equal to addr,
+	// then the first symbol at that address.
+	i := sort.Search(len(idx), func(i int) bool {
+		return idx[i].Addr > addr
+	}) - 1
+	if i < 0 {
+		return Symbol{}, 0, false
+	}
+	sym = idx[idx.search(idx[i].Addr)]
+	return sym, addr - sym.Addr, true
+}
+
+func (idx symbolIndex) around(addr uintptr, k int) []Symbol {
+	if k <= 0 {
+		return nil
+	}
+	var syms []Symbol
+	hi := idx.search(addr)
+	lo := hi - 1
+	for len(syms) < k && (lo >= 0 || hi < len(idx)) {
+		// On ties, prefer the lower address.
+		if hi == len(idx) || (lo >= 0 && addr-idx[lo].Addr <= idx[hi].Addr-addr) {
+			syms = append(syms, idx[lo])
+			lo--
+		} else {
+			syms = append(syms, idx[hi])
+			hi++
+		}
+	}
+	return syms
+}
+
+// Validate performs sanity checks on symtab, and returns a list of the
+// problems it finds, or nil if there are none.
+//
+// Currently, Validate reports global symbols which appear at more than one
+// address with the same name and module. Local symbols are not checked,
+// since distinct static symbols with the same name are common.
+func (symtab SymbolTable) Validate() []error {
+	type key struct {
+		name, module string
+	}
+	addrs := make(map[key][]uintptr)
+	for sym := range symtab {
+		if !sym.Type.Global() {
+			continue
+		}
+		k := key{name: sym.Name, module: sym.Module}
+		addrs[k] = append(addrs[k], sym.Addr)
+	}
+
+	var errs []error
+	keys := make([]key, 0, len(addrs))
+	for k := range addrs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].module != keys[j].module {
+			return keys[i].module < keys[j].module
+		}
+		return keys[i].name < keys[j].name
+	})
+	for _, k := range keys {
+		distinct := uniqueAddrs(addrs[k])
+		if len(distinct) < 2 {
+			continue
+		}
+		where := "the kernel image"
+		if k.module != "" {
+			where = "module " + k.module
+		}
+		errs = append(errs, xerrors.Errorf("linuxkernel: global symbol %q in %s has %d distinct addresses: %#x",
+			k.name, where, len(distinct), distinct))
+	}
+	return errs
+}
+
+// uniqueAddrs sorts addrs and removes duplicates.
+func uniqueAddrs(addrs []uintptr) []uintptr {
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i] < addrs[j]
+	})
+	unique := addrs[:0]
+	for i, addr := range addrs {
+		if i == 0 || addr != addrs[i-1] {
+			unique = append(unique, addr)
+		}
+	}
+	return unique
+}
+
+// WriteTo writes symtab to w in the format of /proc/kallsyms, sorted by
+// address, then by name, such that the output can be read back using
+// ReadSymbols.
+func (symtab SymbolTable) WriteTo(w io.Writer) (int64, error) {
+	symw := &symbolWriter{W: w}
+	for _, sym := range newSymbolIndex(symtab) {
+		symw.Printf("%016x %c %s", sym.Addr, sym.Type, sym.Name)
+		if sym.Module != "" {
+			symw.Printf("\t[%s]", sym.Module)
+		}
+		if sym.Extra != "" {
+			symw.Printf(" %s", sym.Extra)
+		}
+		symw.Printf("\n")
+	}
+	return symw.N, symw.Err
+}
+
+// WriteModule is like WriteTo, but it only writes the symbols which belong
+// to the specified module. If module is empty, it writes the symbols built
+// into the kernel image. If there are no such symbols, WriteModule writes
+// nothing, and returns 0, nil. Use ModuleRange to check whether a module
+// has any symbols beforehand.
+func (symtab SymbolTable) WriteModule(w io.Writer, module string) (int64, error) {
+	modtab := make(SymbolTable)
+	for sym := range symtab {
+		if sym.Module == module {
+			modtab[sym] = struct{}{}
+		}
+	}
+	return modtab.WriteTo(w)
+}
+
+// WritePprofMap writes a symbol map to w, suitable for consumption by
+// profiling tools. Each line has the form "start end name", where start
+// and end are hexadecimal addresses delimiting the half-open range
+// [start, end) covered by the symbol, in address order.
+//
+// Symbol tables do not record symbol sizes, so the end address of a symbol
+// is estimated as the address of the next symbol with a higher address,
+// provided that symbol belongs to the same module, or is also built in.
+// Symbols with no such estimate, such as the last symbol of each module,
+// or of the kernel image, are omitted, since the gaps between modules may
+// be very large. Absolute symbols, whose values are not addresses, are
+// omitted as well.
+func (symtab SymbolTable) WritePprofMap(w io.Writer) (int64, error) {
+	relocatable := make(SymbolTable, len(symtab))
+	for sym := range symtab {
+		if !sym.Type.Absolute() {
+			relocatable[sym] = struct{}{}
+		}
+	}
+	idx := newSymbolIndex(relocatable)
+	symw := &symbolWriter{W: w}
+	for i, sym := range idx {
+		end, ok := idx.end(i)
+		if !ok {
+			continue
+		}
+		symw.Printf("%016x %016x %s\n", sym.Addr, end, sym.Name)
+	}
+	return symw.N, symw.Err
+}
+
+// end returns the estimated end address of the i'th symbol in the index,
+// i.e. the address of the next symbol with a higher address, if any, and
+// if it belongs to the same module as the i'th symbol.
+func (idx symbolIndex) end(i int) (uintptr, bool) {
+	for j := i + 1; j < len(idx); j++ {
+		if idx[j].Addr > idx[i].Addr {
+			return idx[j].Addr, idx[j].Module == idx[i].Module
+		}
+	}
+	return 0, false
+}
+
+type symbolWriter struct {
+	W   io.Writer
+	N   int64
+	Err error // sticky
+}
+
+func (symw *symbolWriter) Printf(format string, args ...interface{}) {
+	if symw.Err != nil {
+		return
+	}
+	var n int
+	n, symw.Err = fmt.Fprintf(symw.W, format, args...)
+	symw.N += int64(n)
+}
+
+// SymbolDiff contains differences between two symbol tables. The slices are
+// sorted by address, then by name, then by module.
+type SymbolDiff struct {
+	// InOld and InNew contain symbols found only in the old and the new
+	// table, respectively. A symbol which moved to a different address
+	// appears in both.
+	InOld []Symbol
+	InNew []Symbol
+
+	// TypeChanged contains symbols found in both tables with the same
+	// name, module and address, but with a different type, e.g. symbols
+	// which changed from local to global.
+	TypeChanged []SymbolTypeChange
+}
+
+// SymbolTypeChange specifies a change in the type of a symbol.
+type SymbolTypeChange struct {
+	Addr             uintptr
+	Name, Module     string
+	OldType, NewType SymbolType
+}
+
+// DiffSymbols returns the differences between the old and new symbol tables.
+func DiffSymbols(old, new SymbolTable) SymbolDiff {
+	type key struct {
+		addr         uintptr
+		name, module string
+	}
+	byKey := func(symtab SymbolTable) map[key]map[SymbolType]Symbol {
+		m := make(map[key]map[SymbolType]Symbol)
+		for sym := range symtab {
+			k := key{addr: sym.Addr, name: sym.Name, module: sym.Module}
+			if m[k] == nil {
+				m[k] = make(map[SymbolType]Symbol)
+			}
+			m[k][sym.Type] = sym
+		}
+		return m
+	}
+	oldByKey := byKey(old)
+	newByKey := byKey(new)
+
+	// onlyIn returns the symbols in a which have a type not found in b.
+	onlyIn := func(a, b map[SymbolType]Symbol) []Symbol {
+		var syms []Symbol
+		for styp, sym := range a {
+			if _, ok := b[styp]; !ok {
+				syms = append(syms, sym)
+			}
+		}
+		return syms
+	}
+
+	var diff SymbolDiff
+	for k, oldsyms := range oldByKey {
+		newsyms := newByKey[k]
+		inOld := onlyIn(oldsyms, newsyms)
+		inNew := onlyIn(newsyms, oldsyms)
+		if len(inOld) == 1 && len(inNew) == 1 {
+			diff.TypeChanged = append(diff.TypeChanged, SymbolTypeChange{
+				Addr:    k.addr,
+				Name:    k.name,
+				Module:  k.module,
+				OldType: inOld[0].Type,
+				NewType: inNew[0].Type,
+			})
+			continue
+		}
+		diff.InOld = append(diff.InOld, inOld...)
+		diff.InNew = append(diff.InNew, inNew...)
+	}
+	for k, newsyms := range newByKey {
+		if _, ok := oldByKey[k]; !ok {
+			diff.InNew = append(diff.InNew, onlyIn(newsyms, nil)...)
+		}
+	}
+	diff.sort()
+	return diff
+}
+
+func (diff SymbolDiff) sort() {
+	sort.Slice(diff.InOld, func(i, j int) bool {
+		return diff.InOld[i].less(diff.InOld[j])
+	})
+	sort.Slice(diff.InNew, func(i, j int) bool {
+		return diff.InNew[i].less(diff.InNew[j])
+	})
+	sort.Slice(diff.TypeChanged, func(i, j int) bool {
+		a, b := diff.TypeChanged[i], diff.TypeChanged[j]
+		if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Module < b.Module
+	})
+}
+
+// SymbolStats summarizes the contents of a SymbolTable.
+type SymbolStats struct {
+	// Counts by symbol type. Weak counts both weak objects and weak
+	// symbols. Other counts symbols of all other types.
+	Text     int
+	Data     int
+	BSS      int
+	Readonly int
+	Weak     int
+	Absolute int
+	Other    int
+
+	// Counts by symbol visibility.
+	Globals int
+	Locals  int
+
+	// ModuleCount is the number of distinct modules symbols belong to.
+	ModuleCount int
+}
+
+// Stats computes summary statistics for symtab.
+func (symtab SymbolTable) Stats() SymbolStats {
+	var stats SymbolStats
+	modules := make(map[string]struct{})
+
+	for sym := range symtab {
+		switch styp := sym.Type; {
+		case styp.Text():
+			stats.Text++
+		case styp.Data():
+			stats.Data++
+		case styp.BSS():
+			stats.BSS++
+		case styp.Readonly():
+			stats.Readonly++
+		case styp.WeakObject(), styp.WeakSymbol():
+			stats.Weak++
+		case styp.Absolute():
+			stats.Absolute++
+		default:
+			stats.Other++
+		}
+		if sym.Type.Global() {
+			stats.Globals++
+		} else {
+			stats.Locals++
+		}
+		if sym.IsModule() {
+			modules[sym.Module] = struct{}{}
+		}
+	}
+	stats.ModuleCount = len(modules)
+
+	return stats
+}
+
 func (symtab SymbolTable) parse(line string) error {
+	sym, err := parseSymbol(line)
+	if err != nil {
+		return err
+	}
+	symtab[sym] = struct{}{}
+	return nil
+}
+
+func parseSymbol(line string) (Symbol, error) {
 	fields := strings.Fields(line)
-	if len(fields) != 3 && len(fields) != 4 {
-		return xerrors.Errorf("linuxkernel: malformed symbol table line %q", line)
+	if len(fields) < 3 || len(fields) > 5 {
+		return Symbol{}, malformedSymbolError{
+			Line: line,
+			Err:  xerrors.Errorf("got %d fields, want between 3 and 5", len(fields)),
+		}
 	}
 
 	var sym Symbol
 
 	addr, err := strconv.ParseUint(fields[0], 16, 64)
 	if err != nil {
-		return xerrors.Errorf("linuxkernel: failed to parse symbol address: %w", err)
+		return Symbol{}, malformedSymbolError{
+			Line: line,
+			Err:  xerrors.Errorf("failed to parse symbol address: %w", err),
+		}
 	}
 	sym.Addr = uintptr(addr)
 
 	symtype := fields[1]
 	if len(symtype) != 1 {
-		return xerrors.Errorf("linuxkernel: unknown symbol type %q", symtype)
+		return Symbol{}, malformedSymbolError{
+			Line: line,
+			Err:  xerrors.Errorf("unknown symbol type %q", symtype),
+		}
 	}
 	sym.Type = SymbolType(symtype[0])
 
+	// The name is a single field. Kernel symbol names never contain
+	// whitespace, so further fields are the optional module field, which
+	// must be enclosed in brackets, followed by the optional extra field.
+	// Brackets in the name itself are preserved: the name field is never
+	// treated as a module, even if it looks like one.
 	sym.Name = fields[2]
+	if len(fields) == 3 {
+		return sym, nil
+	}
+	if !isModuleField(fields[3]) {
+		return Symbol{}, malformedSymbolError{
+			Line: line,
+			Err:  xerrors.Errorf("unexpected field %q after name, want module in brackets", fields[3]),
+		}
+	}
+	sym.Module = fields[3][1 : len(fields[3])-1]
+	if len(fields) == 5 {
+		sym.Extra = fields[4]
+	}
 
-	if len(fields) == 4 {
-		sym.Module = strings.TrimFunc(fields[3], func(r rune) bool {
-			return r == '[' || r == ']'
-		})
+	return sym, nil
+}
+
+// isModuleField returns a boolean indicating whether field looks like the
+// module field of a symbol table line, i.e. a non-empty module name
+// enclosed in brackets. Module names never contain brackets themselves,
+// so fields such as "[a[0]]" or "[a]b]" are not module fields.
+func isModuleField(field string) bool {
+	if len(field) <= 2 || field[0] != '[' || field[len(field)-1] != ']' {
+		return false
 	}
+	return !strings.ContainsAny(field[1:len(field)-1], "[]")
+}
 
-	symtab[sym] = struct{}{}
-	return nil
+// ErrMalformedSymbol is matched by errors returned when a line in a
+// symbol table cannot be parsed. Such errors can be distinguished from
+// I/O errors using xerrors.Is(err, ErrMalformedSymbol).
+var ErrMalformedSymbol = xerrors.New("linuxkernel: malformed symbol table line")
+
+// malformedSymbolError records a symbol table line which could not be
+// parsed, and the reason why.
+type malformedSymbolError struct {
+	Line string
+	Err  error
+}
+
+func (e malformedSymbolError) Error() string {
+	return fmt.Sprintf("linuxkernel: malformed symbol table line %q: %v", e.Line, e.Err)
+}
+
+func (e malformedSymbolError) Is(target error) bool {
+	return target == ErrMalformedSymbol
+}
+
+func (e malformedSymbolError) Unwrap() error {
+	return e.Err
 }
 
 // Kallsyms calls ParseSymbols("/proc/kallsyms").
@@ -155,17 +927,247 @@ func ParseSymbols(path string) (SymbolTable, error) {
 	}
 	defer f.Close()
 
+	return ReadSymbols(f)
+}
+
+// ReadSymbols reads kernel symbols from r, until EOF. The input must be in
+// the format of /proc/kallsyms. Blank lines, and lines starting with '#',
+// are ignored, as they are by ParseConfig.
+func ReadSymbols(r io.Reader) (SymbolTable, error) {
+	return symbolReader{}.read(r)
+}
+
+// ReadSymbolsWithSources is like ReadSymbols, but it also records source
+// as the source of each symbol it reads, in sources, as sources.Add does.
+// Besides /proc/kallsyms (SourceKallsyms), ReadSymbols understands the
+// System.map file (SourceSystemMap), and the output of nm (SourceNM), which
+// have the same format, so source should be chosen according to the input.
+// If ReadSymbolsWithSources returns an error, sources is left unchanged.
+func ReadSymbolsWithSources(r io.Reader, source string, sources SymbolSources) (SymbolTable, error) {
+	symtab, err := ReadSymbols(r)
+	if err != nil {
+		return nil, err
+	}
+	sources.Add(symtab, source)
+	return symtab, nil
+}
+
+// ReadSymbolsWithRaw is like ReadSymbols, but it also returns the line each
+// symbol was parsed from, for diagnostic purposes. If several lines parse
+// to the same symbol, the last one is recorded. The lines are returned
+// separately, rather than as part of each Symbol, so that they do not
+// affect the identity of symbols in the table.
+func ReadSymbolsWithRaw(r io.Reader) (SymbolTable, map[Symbol]string, error) {
+	raw := make(map[Symbol]string)
+	symtab, err := symbolReader{Raw: raw}.read(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return symtab, raw, nil
+}
+
+// ReadSymbolsFilter is like ReadSymbols, but it only records the symbols
+// whose names satisfy keep. This is useful for reducing memory usage, when
+// only a known subset of the symbol table is of interest. Lines are still
+// parsed and validated in full, even if their symbols are discarded.
+func ReadSymbolsFilter(r io.Reader, keep func(name string) bool) (SymbolTable, error) {
+	return symbolReader{Keep: keep}.read(r)
+}
+
+// ReadSymbolsLenient is like ReadSymbols, but it tolerates a malformed final
+// line. Reading /proc/kallsyms is inherently racy: if modules are loaded or
+// unloaded during the read, the last line may be truncated.
+//
+// Only the last non-blank, non-comment line of the input is treated this
+// way: if it fails to parse, it is skipped silently, even if blank lines or
+// comments follow it. A malformed line anywhere else in the input is still
+// an error.
+func ReadSymbolsLenient(r io.Reader) (SymbolTable, error) {
+	return symbolReader{Lenient: true}.read(r)
+}
+
+// symbolReader reads symbol tables.
+type symbolReader struct {
+	// Lenient indicates whether a malformed final line is skipped.
+	Lenient bool
+
+	// Raw, if not nil, records the line each symbol was parsed from.
+	Raw map[Symbol]string
+
+	// Keep, if not nil, selects the symbols to record, by name.
+	Keep func(name string) bool
+}
+
+func (sr symbolReader) read(r io.Reader) (SymbolTable, error) {
 	symtab := make(SymbolTable)
 
-	sc := bufio.NewScanner(f)
+	// If parsing a line fails, the error is held in pending until the
+	// next line is seen, since we can't know if the line was the last one.
+	var pending error
+
+	sc := bufio.NewScanner(r)
 	for sc.Scan() {
-		if err := symtab.parse(sc.Text()); err != nil {
-			return nil, err
+		line := sc.Text()
+		if isSymbolComment(line) {
+			continue
+		}
+		if pending != nil {
+			return nil, pending
+		}
+		sym, err := parseSymbol(line)
+		if err != nil {
+			pending = err
+			continue
+		}
+		if sr.Keep != nil && !sr.Keep(sym.Name) {
+			continue
 		}
+		if sr.Raw != nil {
+			sr.Raw[sym] = line
+		}
+		symtab[sym] = struct{}{}
 	}
 	if err := sc.Err(); err != nil {
 		return nil, err
 	}
+	if pending != nil && !sr.Lenient {
+		return nil, pending
+	}
 
 	return symtab, nil
 }
+
+// isSymbolComment returns true if line is blank, or a comment.
+func isSymbolComment(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+// ConcurrentSymbolTable wraps a SymbolTable for use by multiple goroutines.
+// The sorted index used to resolve addresses is built once, on first use,
+// and shared by all subsequent lookups. A ConcurrentSymbolTable is safe for
+// concurrent use by multiple goroutines. The zero value is an empty table,
+// ready to use.
+type ConcurrentSymbolTable struct {
+	mu      sync.RWMutex
+	symtab  SymbolTable
+	indexed bool // whether idx is built
+	idx     symbolIndex
+}
+
+// NewConcurrentSymbolTable returns a ConcurrentSymbolTable holding a copy
+// of symtab. Later modifications to symtab are not observed.
+func NewConcurrentSymbolTable(symtab SymbolTable) *ConcurrentSymbolTable {
+	ct := new(ConcurrentSymbolTable)
+	ct.Replace(symtab)
+	return ct
+}
+
+// Replace replaces the contents of the table with a copy of symtab. The
+// index is rebuilt on the next call to Resolve.
+func (ct *ConcurrentSymbolTable) Replace(symtab SymbolTable) {
+	cp := make(SymbolTable, len(symtab))
+	for sym := range symtab {
+		cp[sym] = struct{}{}
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.symtab = cp
+	ct.indexed = false
+	ct.idx = nil
+}
+
+// Resolve is like SymbolTable.Resolve.
+func (ct *ConcurrentSymbolTable) Resolve(addr uintptr) (sym Symbol, offset uintptr, ok bool) {
+	ct.mu.RLock()
+	if ct.indexed {
+		defer ct.mu.RUnlock()
+		return ct.idx.resolve(addr)
+	}
+	ct.mu.RUnlock()
+
+	// The index must be built. Another goroutine may have done so, or
+	// may have called Replace, between RUnlock and Lock, so check again.
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if !ct.indexed {
+		ct.idx = newSymbolIndex(ct.symtab)
+		ct.indexed = true
+	}
+	return ct.idx.resolve(addr)
+}
+
+// Find is like SymbolTable.Find.
+func (ct *ConcurrentSymbolTable) Find(name string) []Symbol {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+
+	return ct.symtab.Find(name)
+}
+
+// LiveSymbols tracks the symbol table of the running kernel, which changes
+// as modules are loaded and unloaded. It is safe for concurrent use by
+// multiple goroutines: Resolve and Table may be called concurrently with
+// Refresh, and observe either the previous or the new snapshot of the
+// symbol table.
+//
+// The symbol table is empty until the first call to Refresh.
+type LiveSymbols struct {
+	// Path is the path to the symbol table. If empty, /proc/kallsyms
+	// is used.
+	Path string
+
+	mu     sync.RWMutex
+	symtab SymbolTable
+	idx    symbolIndex
+}
+
+// Refresh re-reads the symbol table, and atomically replaces the current
+// snapshot with the new one. Since the symbol table may change while it is
+// being read, a truncated final line is tolerated, as by ReadSymbolsLenient.
+// If Refresh fails, the current snapshot is left untouched.
+func (ls *LiveSymbols) Refresh() error {
+	path := ls.Path
+	if path == "" {
+		path = "/proc/kallsyms"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	symtab, err := ReadSymbolsLenient(f)
+	if err != nil {
+		return err
+	}
+	idx := newSymbolIndex(symtab)
+
+	ls.mu.Lock()
+	ls.symtab = symtab
+	ls.idx = idx
+	ls.mu.Unlock()
+
+	return nil
+}
+
+// Resolve is like SymbolTable.Resolve, but it uses the current snapshot of
+// the symbol table, and does not need to sort it.
+func (ls *LiveSymbols) Resolve(addr uintptr) (sym Symbol, offset uintptr, ok bool) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	return ls.idx.resolve(addr)
+}
+
+// Table returns the current snapshot of the symbol table. The caller must
+// not modify it.
+func (ls *LiveSymbols) Table() SymbolTable {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	return ls.symtab
+}
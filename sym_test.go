@@ -0,0 +1,1181 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+const testSymbols = `ffffffff81000000 T _stext
+ffffffff81000010 t do_one_initcall
+ffffffff82000000 D init_task
+ffffffff82100000 d some_local_data
+ffffffff82200000 R linux_banner
+ffffffff82300000 B jiffies_64
+ffffffff82300010 b local_bss
+ffffffff82400000 W weak_function
+ffffffff82400010 V weak_object
+0000000000000000 A irq_stack_union
+ffffffff82500000 u unique_global
+ffffffffc0002000 t nf_hook_local	[nf_conntrack]
+ffffffffc0002100 T nf_conntrack_in	[nf_conntrack]
+ffffffffc0100000 T ext4_fill_super	[ext4]
+`
+
+func mustParseSymbols(t *testing.T, input string) SymbolTable {
+	t.Helper()
+	symtab := make(SymbolTable)
+	for _, line := range strings.Split(strings.TrimSpace(input), "\n") {
+		if err := symtab.parse(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return symtab
+}
+
+func TestReadSymbols(t *testing.T) {
+	t.Run("Basic", testReadSymbolsBasic)
+	t.Run("Lenient", testReadSymbolsLenient)
+	t.Run("Comments", testReadSymbolsComments)
+	t.Run("WithRaw", testReadSymbolsWithRaw)
+	t.Run("Filter", testReadSymbolsFilter)
+	t.Run("Malformed", testReadSymbolsMalformed)
+	t.Run("Extra", testReadSymbolsExtra)
+	t.Run("EdgeCaseNames", testReadSymbolsEdgeCaseNames)
+}
+
+func testReadSymbolsBasic(t *testing.T) {
+	symtab, err := ReadSymbols(strings.NewReader(testSymbols))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(symtab), 14; got != want {
+		t.Fatalf("got %d symbols, want %d", got, want)
+	}
+	want := Symbol{
+		Addr:   0xffffffffc0002100,
+		Type:   'T',
+		Name:   "nf_conntrack_in",
+		Module: "nf_conntrack",
+	}
+	if _, ok := symtab[want]; !ok {
+		t.Fatalf("symbol %v not found", want)
+	}
+}
+
+func testReadSymbolsLenient(t *testing.T) {
+	truncated := testSymbols + "ffffffffc01"
+	if _, err := ReadSymbols(strings.NewReader(truncated)); err == nil {
+		t.Fatal("ReadSymbols succeeded on truncated input")
+	}
+	symtab, err := ReadSymbolsLenient(strings.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(symtab), 14; got != want {
+		t.Fatalf("got %d symbols, want %d", got, want)
+	}
+
+	corrupt := "ffffffffc01\n" + testSymbols
+	if _, err := ReadSymbolsLenient(strings.NewReader(corrupt)); err == nil {
+		t.Fatal("ReadSymbolsLenient succeeded on malformed line in the middle")
+	}
+
+	// Blank lines and comments after the malformed line do not count.
+	trailing := truncated + "\n\n# end of dump\n  \n"
+	symtab, err = ReadSymbolsLenient(strings.NewReader(trailing))
+	if err != nil {
+		t.Fatalf("ReadSymbolsLenient failed on truncated line followed by comments: %v", err)
+	}
+	if got, want := len(symtab), 14; got != want {
+		t.Fatalf("got %d symbols, want %d", got, want)
+	}
+	if _, err := ReadSymbolsLenient(strings.NewReader(trailing + testSymbols)); err == nil {
+		t.Fatal("ReadSymbolsLenient succeeded on malformed line followed by symbols")
+	}
+}
+
+func testReadSymbolsComments(t *testing.T) {
+	input := "# kallsyms dump, vmlinux\n\n" +
+		strings.Replace(testSymbols, "ffffffffc0002100", "\n  # modules\nffffffffc0002100", 1) +
+		"\n# end of dump\n"
+	symtab, err := ReadSymbols(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustParseSymbols(t, testSymbols)
+	if !reflect.DeepEqual(symtab, want) {
+		t.Fatalf("got %v, want %v", symtab, want)
+	}
+
+	// A trailing comment does not hide a malformed line before it.
+	truncated := testSymbols + "ffffffffc01\n# trailing comment\n"
+	if _, err := ReadSymbols(strings.NewReader(truncated)); err == nil {
+		t.Fatal("ReadSymbols succeeded on truncated input followed by a comment")
+	}
+	if _, err := ReadSymbolsLenient(strings.NewReader(truncated)); err != nil {
+		t.Fatalf("ReadSymbolsLenient failed on truncated input followed by a comment: %v", err)
+	}
+}
+
+func testReadSymbolsWithRaw(t *testing.T) {
+	symtab, raw, err := ReadSymbolsWithRaw(strings.NewReader(testSymbols))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ReadSymbols(strings.NewReader(testSymbols))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(symtab, plain) {
+		t.Fatalf("ReadSymbolsWithRaw: got %v, want the same table as ReadSymbols, %v", symtab, plain)
+	}
+	if len(raw) != len(symtab) {
+		t.Fatalf("got %d raw lines for %d symbols", len(raw), len(symtab))
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(testSymbols), "\n") {
+		lines[line] = true
+	}
+	for sym := range symtab {
+		line, ok := raw[sym]
+		if !ok || !lines[line] {
+			t.Errorf("symbol %v has raw line %q, which is not an input line", sym, line)
+			continue
+		}
+		if _, ok := mustParseSymbols(t, line)[sym]; !ok {
+			t.Errorf("raw line of %v does not parse to the same symbol", sym)
+		}
+	}
+
+	// Lines which differ only in whitespace denote the same symbol.
+	input := "ffffffff81000000 T _stext\nffffffff81000000  T  _stext \n"
+	symtab, raw, err = ReadSymbolsWithRaw(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Symbol{Addr: 0xffffffff81000000, Type: 'T', Name: "_stext"}
+	if _, ok := symtab[want]; !ok || len(symtab) != 1 {
+		t.Fatalf("got %v, want only %v", symtab, want)
+	}
+	if got, want := raw[want], "ffffffff81000000  T  _stext "; got != want {
+		t.Errorf("raw line = %q, want %q", got, want)
+	}
+}
+
+func testReadSymbolsFilter(t *testing.T) {
+	keep := map[string]bool{"_stext": true, "nf_conntrack_in": true, "missing": true}
+	symtab, err := ReadSymbolsFilter(strings.NewReader(testSymbols), func(name string) bool {
+		return keep[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mustParseSymbols(t, `ffffffff81000000 T _stext
+ffffffffc0002100 T nf_conntrack_in	[nf_conntrack]`)
+	if !reflect.DeepEqual(symtab, want) {
+		t.Fatalf("got %v, want %v", symtab, want)
+	}
+
+	malformed := testSymbols + "ffffffff81000000\n" + testSymbols
+	none := func(string) bool { return false }
+	if _, err := ReadSymbolsFilter(strings.NewReader(malformed), none); err == nil {
+		t.Fatal("ReadSymbolsFilter succeeded on malformed input")
+	}
+}
+
+func testReadSymbolsMalformed(t *testing.T) {
+	lines := []string{
+		"ffffffff81000000 T",
+		"ffffffff81000000 T a b c d",
+		"ffffffff81000000 T name extra",
+		"ffffffff81000000 T odd name with spaces",
+		"ffffffff81000000 T name [a[0]]",
+		"ffffffff81000000 T name []",
+		"ffffffff81000000 T name [mod] extra more",
+		"ffffffff81000000",
+		"zzzzzzzzzzzzzzzz T _stext",
+		"ffffffff81000000 TT _stext",
+	}
+	for _, line := range lines {
+		_, err := ReadSymbols(strings.NewReader(line + "\n"))
+		if err == nil {
+			t.Fatalf("ReadSymbols(%q) succeeded", line)
+		}
+		if !xerrors.Is(err, ErrMalformedSymbol) {
+			t.Fatalf("ReadSymbols(%q): error %v does not match ErrMalformedSymbol", line, err)
+		}
+		if !strings.Contains(err.Error(), strconv.Quote(line)) {
+			t.Fatalf("ReadSymbols(%q): error %q does not mention the line", line, err)
+		}
+	}
+
+	_, err := ReadSymbols(strings.NewReader("zzzz T _stext\n"))
+	var numerr *strconv.NumError
+	if !xerrors.As(err, &numerr) {
+		t.Fatalf("error %v does not wrap the address parsing error", err)
+	}
+}
+
+func testReadSymbolsExtra(t *testing.T) {
+	line := "ffffffffc0002100 T nf_conntrack_in\t[nf_conntrack]\trel"
+	symtab, err := ReadSymbols(strings.NewReader(line + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Symbol{
+		Addr:   0xffffffffc0002100,
+		Type:   'T',
+		Name:   "nf_conntrack_in",
+		Module: "nf_conntrack",
+		Extra:  "rel",
+	}
+	if _, ok := symtab[want]; !ok {
+		t.Fatalf("ReadSymbols(%q): %v not found in %v", line, want, symtab)
+	}
+	if got, want := want.String(), "ffffffffc0002100 T nf_conntrack_in [nf_conntrack] rel"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+	reparsed, err := ReadSymbols(strings.NewReader(want.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reparsed[want]; !ok {
+		t.Fatalf("ReadSymbols(%q) = %v, want %v", want.String(), reparsed, want)
+	}
+}
+
+func testReadSymbolsEdgeCaseNames(t *testing.T) {
+	tests := []struct {
+		Line string
+		Want Symbol
+	}{
+		{
+			Line: "ffffffffc0002000 t name.with$odd:chars\t[mod-with-dashes]",
+			Want: Symbol{Addr: 0xffffffffc0002000, Type: 't', Name: "name.with$odd:chars", Module: "mod-with-dashes"},
+		},
+		{
+			Line: "ffffffffc0002000 t name\t[mod]\textra",
+			Want: Symbol{Addr: 0xffffffffc0002000, Type: 't', Name: "name", Module: "mod", Extra: "extra"},
+		},
+		{
+			Line: "ffffffffc0002000 t [not_a_module]",
+			Want: Symbol{Addr: 0xffffffffc0002000, Type: 't', Name: "[not_a_module]"},
+		},
+		{
+			Line: "ffffffffc0002000 t table[3]\t[mod]",
+			Want: Symbol{Addr: 0xffffffffc0002000, Type: 't', Name: "table[3]", Module: "mod"},
+		},
+		{
+			Line: "ffffffffc0002000 t name [mod]",
+			Want: Symbol{Addr: 0xffffffffc0002000, Type: 't', Name: "name", Module: "mod"},
+		},
+		{
+			Line: "ffffffffc0002000 t name [mod] extra",
+			Want: Symbol{Addr: 0xffffffffc0002000, Type: 't', Name: "name", Module: "mod", Extra: "extra"},
+		},
+		{
+			Line: "ffffffffc0002000 t [weird][name]\t[mod]",
+			Want: Symbol{Addr: 0xffffffffc0002000, Type: 't', Name: "[weird][name]", Module: "mod"},
+		},
+	}
+	for _, tt := range tests {
+		symtab, err := ReadSymbols(strings.NewReader(tt.Line + "\n"))
+		if err != nil {
+			t.Errorf("ReadSymbols(%q): %v", tt.Line, err)
+			continue
+		}
+		if _, ok := symtab[tt.Want]; !ok || len(symtab) != 1 {
+			t.Errorf("ReadSymbols(%q) = %+v, want %+v", tt.Line, symtab, tt.Want)
+		}
+	}
+}
+
+func TestConcurrentSymbolTable(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	ct := NewConcurrentSymbolTable(symtab)
+
+	// Modifications to the original table are not observed.
+	for sym := range symtab {
+		delete(symtab, sym)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 8*len(resolveTests))
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, tt := range resolveTests {
+				sym, offset, ok := ct.Resolve(tt.Addr)
+				if ok != tt.WantOK || sym.Name != tt.WantName || offset != tt.WantOffset {
+					errs <- fmt.Sprintf("Resolve(%#x) = %v, %#x, %t, want %s, %#x, %t",
+						tt.Addr, sym, offset, ok, tt.WantName, tt.WantOffset, tt.WantOK)
+				}
+			}
+			if got := ct.Find("jiffies_64"); len(got) != 1 {
+				errs <- fmt.Sprintf("Find(jiffies_64) = %v, want one symbol", got)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	ct.Replace(mustParseSymbols(t, "0000000000001000 T only"))
+	if sym, offset, _ := ct.Resolve(0xffffffff81000004); sym.Name != "only" || offset != 0xffffffff81000004-0x1000 {
+		t.Errorf("after Replace, Resolve resolved to %v+%#x, want only", sym, offset)
+	}
+	if got := ct.Find("_stext"); len(got) != 0 {
+		t.Errorf("after Replace, Find(_stext) = %v, want none", got)
+	}
+
+	var zero ConcurrentSymbolTable
+	if sym, offset, ok := zero.Resolve(0x1000); ok {
+		t.Errorf("zero value: Resolve(0x1000) = %v, %#x, %t, want no symbol", sym, offset, ok)
+	}
+	if got := zero.Find("only"); len(got) != 0 {
+		t.Errorf("zero value: Find(only) = %v, want none", got)
+	}
+	zero.Replace(mustParseSymbols(t, "0000000000001000 T only"))
+	if sym, _, ok := zero.Resolve(0x1004); !ok || sym.Name != "only" {
+		t.Errorf("zero value: after Replace, Resolve(0x1004) = %v, %t, want only", sym, ok)
+	}
+}
+
+func TestLiveSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kallsyms")
+	if err := ioutil.WriteFile(path, []byte(testSymbols), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ls := &LiveSymbols{Path: path}
+	if _, _, ok := ls.Resolve(0xffffffff81000000); ok {
+		t.Fatal("Resolve succeeded before Refresh")
+	}
+	if err := ls.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range resolveTests {
+		sym, offset, ok := ls.Resolve(tt.Addr)
+		if ok != tt.WantOK || sym.Name != tt.WantName || offset != tt.WantOffset {
+			t.Errorf("Resolve(%#x) = %v, %#x, %t, want %s, %#x, %t",
+				tt.Addr, sym, offset, ok, tt.WantName, tt.WantOffset, tt.WantOK)
+		}
+	}
+
+	// Simulate unloading the ext4 module.
+	unloaded := strings.Replace(testSymbols, "ffffffffc0100000 T ext4_fill_super\t[ext4]\n", "", 1)
+	if err := ioutil.WriteFile(path, []byte(unloaded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if sym, _, _ := ls.Resolve(0xffffffffc0100010); sym.Name != "nf_conntrack_in" {
+		t.Errorf("after Refresh, Resolve(0xffffffffc0100010) = %v, want nf_conntrack_in", sym)
+	}
+	if got, want := len(ls.Table()), 13; got != want {
+		t.Errorf("after Refresh, got %d symbols, want %d", got, want)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Refresh(); err == nil {
+		t.Fatal("Refresh succeeded on missing file")
+	}
+	if got, want := len(ls.Table()), 13; got != want {
+		t.Errorf("after failed Refresh, got %d symbols, want %d", got, want)
+	}
+}
+
+func TestSymbolType(t *testing.T) {
+	tests := []struct {
+		Type   SymbolType
+		Check  func(SymbolType) bool
+		Global bool
+	}{
+		{SymbolTypeAbsolute, SymbolType.Absolute, true},
+		{SymbolTypeAbsoluteLocal, SymbolType.Absolute, false},
+		{SymbolTypeBSS, SymbolType.BSS, true},
+		{SymbolTypeBSSLocal, SymbolType.BSS, false},
+		{SymbolTypeData, SymbolType.Data, true},
+		{SymbolTypeDataLocal, SymbolType.Data, false},
+		{SymbolTypeReadonly, SymbolType.Readonly, true},
+		{SymbolTypeReadonlyLocal, SymbolType.Readonly, false},
+		{SymbolTypeText, SymbolType.Text, true},
+		{SymbolTypeTextLocal, SymbolType.Text, false},
+		{SymbolTypeWeakObject, SymbolType.WeakObject, true},
+		{SymbolTypeWeakObjectNoDefault, SymbolType.WeakObject, false},
+		{SymbolTypeWeakSymbol, SymbolType.WeakSymbol, true},
+		{SymbolTypeWeakSymbolNoDefault, SymbolType.WeakSymbol, false},
+		{SymbolTypeIndirect, SymbolType.Indirect, true},
+		{SymbolTypeIndirectLocal, SymbolType.Indirect, false},
+		{SymbolTypeUniqueGlobal, SymbolType.Global, true},
+	}
+	for _, tt := range tests {
+		if !tt.Check(tt.Type) {
+			t.Errorf("%c: accessor returned false", tt.Type)
+		}
+		if got := tt.Type.Global(); got != tt.Global {
+			t.Errorf("%c: Global() = %t, want %t", tt.Type, got, tt.Global)
+		}
+	}
+
+	symtab := mustParseSymbols(t, testSymbols)
+	if got := symtab.Find("_stext"); len(got) != 1 || got[0].Type != SymbolTypeText {
+		t.Errorf("_stext: got %v, want type %c", got, SymbolTypeText)
+	}
+	if got := symtab.Find("unique_global"); len(got) != 1 || !got[0].Type.Global() {
+		t.Errorf("unique_global: got %v, want a global symbol", got)
+	}
+}
+
+func TestParseModules(t *testing.T) {
+	input := `nf_conntrack_netlink 53248 0 - Live 0xffffffffc0b2a000
+nf_nat 49152 1 nf_conntrack_netlink, Live 0xffffffffc0a1b000
+nf_conntrack 172032 3 nf_conntrack_netlink,nf_nat, Live 0xffffffffc0002000
+vboxdrv 487424 2 - Loading 0x0000000000000000 (OE)
+`
+	got, err := ParseModules(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Module{
+		{Name: "nf_conntrack_netlink", Size: 53248, Base: 0xffffffffc0b2a000, RefCount: 0, State: "Live"},
+		{Name: "nf_nat", Size: 49152, Base: 0xffffffffc0a1b000, RefCount: 1, UsedBy: []string{"nf_conntrack_netlink"}, State: "Live"},
+		{Name: "nf_conntrack", Size: 172032, Base: 0xffffffffc0002000, RefCount: 3, UsedBy: []string{"nf_conntrack_netlink", "nf_nat"}, State: "Live"},
+		{Name: "vboxdrv", Size: 487424, Base: 0, RefCount: 2, State: "Loading"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// Cross-reference with the symbol table: nf_conntrack symbols lie
+	// within the module.
+	symtab := mustParseSymbols(t, testSymbols)
+	lo, hi, ok := symtab.ModuleRange("nf_conntrack")
+	mod := got[2]
+	if !ok || lo < mod.Base || hi >= mod.Base+mod.Size {
+		t.Errorf("nf_conntrack symbols [%#x, %#x] outside module [%#x, %#x)", lo, hi, mod.Base, mod.Base+mod.Size)
+	}
+
+	bad := []string{
+		"nf_nat 49152 1 - Live",
+		"nf_nat big 1 - Live 0xffffffffc0a1b000",
+		"nf_nat 49152 x - Live 0xffffffffc0a1b000",
+		"nf_nat 49152 1 - Live zzz",
+	}
+	for _, line := range bad {
+		if _, err := ParseModules(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseModules(%q) succeeded", line)
+		}
+	}
+}
+
+func TestParseObjdumpSymbols(t *testing.T) {
+	input := `
+vmlinux:     file format elf64-x86-64
+
+
+Disassembly of section .text:
+
+ffffffff81000000 <_stext>:
+ffffffff81000000:	48 8d 25 51 3f 60 01 	lea    0x1603f51(%rip),%rsp        # ffffffff82603f58 <init_thread_union+0x3f58>
+
+ffffffff81000070 <secondary_startup_64>:
+ffffffff81000070:	e8 00 00 00 00       	call   ffffffff81000075 <secondary_startup_64+0x5>
+
+0000000000001030 <puts@plt>:
+    1030:	ff 25 e2 2f 00 00    	jmp    *0x2fe2(%rip)        # 4018 <puts@GLIBC_2.2.5>
+`
+	got, err := ParseObjdumpSymbols(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SymbolTable{
+		{Addr: 0xffffffff81000000, Type: SymbolTypeUnknown, Name: "_stext"}:               struct{}{},
+		{Addr: 0xffffffff81000070, Type: SymbolTypeUnknown, Name: "secondary_startup_64"}: struct{}{},
+		{Addr: 0x1030, Type: SymbolTypeUnknown, Name: "puts@plt"}:                         struct{}{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	bad := []string{
+		"1ffffffff81000000 <overflow>:",
+		"ffffffff81000000 <>:",
+	}
+	for _, line := range bad {
+		_, err := ParseObjdumpSymbols(strings.NewReader(line))
+		if !xerrors.Is(err, ErrMalformedSymbol) {
+			t.Errorf("ParseObjdumpSymbols(%q): got error %v, want ErrMalformedSymbol", line, err)
+		}
+	}
+}
+
+func TestSymbolAddrString(t *testing.T) {
+	sym := Symbol{Addr: 0x1000, Type: 'T', Name: "a"}
+	if got, want := sym.AddrString(), "0000000000001000"; got != want {
+		t.Fatalf("AddrString() = %q, want %q", got, want)
+	}
+	if got, want := sym.String(), "0000000000001000 T a"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestSymbolDemangle(t *testing.T) {
+	tests := []struct {
+		Name, Want string
+	}{
+		{
+			Name: "do_one_initcall",
+			Want: "do_one_initcall",
+		},
+		{
+			Name: "_RNvC6_123foo3bar",
+			Want: "123foo::bar",
+		},
+		{
+			Name: "_RNvNtCs1234_7mycrate3foo3bar",
+			Want: "mycrate::foo::bar",
+		},
+		{
+			Name: "_RNCNCNgCs6DXkGYLi8lr_2cc5spawn00B5_",
+			Want: "cc::spawn::{closure#0}::{closure#0}",
+		},
+		{
+			Name: "_RNqCs4fqI2P2rA04_11utf8_identsu30____7hkackfecea1cbdathfdh9hlq6y",
+			Want: "utf8_idents::საჭმელად_გემრიელი_სადილი",
+		},
+		{
+			Name: "_RINbNbCskIICzLVDPPb_5alloc5alloc8box_freeDINbNiB4_5boxed5FnBoxuEp6OutputuEL_ECs1iopQbuBiw2_3std",
+			Want: "alloc::alloc::box_free::<dyn alloc::boxed::FnBox<(), Output = ()>>",
+		},
+		{
+			Name: "_RNvMsr_NtCs3ssYzQotkvD_3std4pathNtB5_7PathBuf3new",
+			Want: "<std::path::PathBuf>::new",
+		},
+		{
+			Name: "_RINvNtC3std3mem8align_ofjE",
+			Want: "std::mem::align_of::<usize>",
+		},
+		{
+			Name: "_RINtC8arrayvec8ArrayVechKj7b_E",
+			Want: "arrayvec::ArrayVec::<u8, 123>",
+		},
+		{
+			Name: "_RINvC1a1fTRhQShEE",
+			Want: "a::f::<(&u8, &mut [u8])>",
+		},
+		{
+			Name: "_RINvC1a1fFUKCjEuE",
+			Want: `a::f::<unsafe extern "C" fn(usize)>`,
+		},
+		{
+			Name: "_RNvNtCs1234_7mycrate3foo3bar.llvm.123",
+			Want: "mycrate::foo::bar",
+		},
+		{
+			Name: "_RNvC",
+			Want: "_RNvC",
+		},
+		{
+			Name: "_RNvB0_3foo",
+			Want: "_RNvB0_3foo",
+		},
+	}
+	for _, tt := range tests {
+		sym := Symbol{Name: tt.Name}
+		if got := sym.Demangle(); got != tt.Want {
+			t.Errorf("Demangle(%q) = %q, want %q", tt.Name, got, tt.Want)
+		}
+	}
+}
+
+func TestSymbolSources(t *testing.T) {
+	kallsyms := mustParseSymbols(t, testSymbols)
+	systemMap := mustParseSymbols(t, `ffffffff81000000 T _stext
+ffffffff81000010 t do_one_initcall
+ffffffff81000020 t only_in_system_map`)
+
+	merged := make(SymbolTable)
+	sources := make(SymbolSources)
+	for _, src := range []struct {
+		Name   string
+		Symtab SymbolTable
+	}{
+		{Name: SourceKallsyms, Symtab: kallsyms},
+		{Name: SourceSystemMap, Symtab: systemMap},
+		{Name: SourceKallsyms, Symtab: kallsyms},
+	} {
+		for sym := range src.Symtab {
+			merged[sym] = struct{}{}
+		}
+		sources.Add(src.Symtab, src.Name)
+	}
+
+	if got, want := len(merged), len(kallsyms)+1; got != want {
+		t.Fatalf("merged table has %d symbols, want %d", got, want)
+	}
+	if len(sources) != len(merged) {
+		t.Fatalf("got sources for %d symbols, want %d", len(sources), len(merged))
+	}
+	tests := []struct {
+		Name string
+		Want []string
+	}{
+		{Name: "_stext", Want: []string{SourceKallsyms, SourceSystemMap}},
+		{Name: "only_in_system_map", Want: []string{SourceSystemMap}},
+		{Name: "jiffies_64", Want: []string{SourceKallsyms}},
+	}
+	for _, tt := range tests {
+		syms := merged.Find(tt.Name)
+		if len(syms) != 1 {
+			t.Fatalf("Find(%q) = %v, want one symbol", tt.Name, syms)
+		}
+		if got := sources[syms[0]]; !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("sources of %s = %q, want %q", tt.Name, got, tt.Want)
+		}
+	}
+}
+
+func TestReadSymbolsWithSources(t *testing.T) {
+	sources := make(SymbolSources)
+	kallsyms, err := ReadSymbolsWithSources(strings.NewReader(testSymbols), SourceKallsyms, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	systemMap, err := ReadSymbolsWithSources(strings.NewReader(`ffffffff81000000 T _stext
+ffffffff81000020 t only_in_system_map`), SourceSystemMap, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objdump, err := ParseObjdumpSymbolsWithSources(strings.NewReader(`ffffffff81000000 <_stext>:
+ffffffff81000000:	48 8d 25 51 3f 60 01 	lea    0x1603f51(%rip),%rsp`), sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kallsyms) != 14 || len(systemMap) != 2 || len(objdump) != 1 {
+		t.Fatalf("got %d, %d and %d symbols, want 14, 2 and 1", len(kallsyms), len(systemMap), len(objdump))
+	}
+
+	stext := Symbol{Addr: 0xffffffff81000000, Type: SymbolTypeText, Name: "_stext"}
+	if got, want := sources[stext], []string{SourceKallsyms, SourceSystemMap}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sources of %v = %q, want %q", stext, got, want)
+	}
+	stext.Type = SymbolTypeUnknown
+	if got, want := sources[stext], []string{SourceObjdump}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sources of %v = %q, want %q", stext, got, want)
+	}
+	if got, want := len(sources), 14+1+1; got != want {
+		t.Errorf("got sources for %d symbols, want %d", got, want)
+	}
+
+	// On error, sources is left unchanged.
+	if _, err := ReadSymbolsWithSources(strings.NewReader("ffffffff82000000 T new\nzzzz\n"), SourceNM, sources); err == nil {
+		t.Fatal("ReadSymbolsWithSources succeeded on malformed input")
+	}
+	if got, want := len(sources), 14+1+1; got != want {
+		t.Errorf("after error, got sources for %d symbols, want %d", got, want)
+	}
+}
+
+func TestDiffSymbols(t *testing.T) {
+	old := mustParseSymbols(t, `0000000000001000 T unchanged
+0000000000002000 t made_global
+0000000000003000 T removed
+0000000000004000 T moved
+0000000000005000 D became_text	[mod]`)
+	new := mustParseSymbols(t, `0000000000001000 T unchanged
+0000000000002000 T made_global
+0000000000004100 T moved
+0000000000005000 T became_text	[mod]
+0000000000006000 T added`)
+	got := DiffSymbols(old, new)
+	want := SymbolDiff{
+		InOld: []Symbol{
+			{Addr: 0x3000, Type: 'T', Name: "removed"},
+			{Addr: 0x4000, Type: 'T', Name: "moved"},
+		},
+		InNew: []Symbol{
+			{Addr: 0x4100, Type: 'T', Name: "moved"},
+			{Addr: 0x6000, Type: 'T', Name: "added"},
+		},
+		TypeChanged: []SymbolTypeChange{
+			{Addr: 0x2000, Name: "made_global", OldType: 't', NewType: 'T'},
+			{Addr: 0x5000, Name: "became_text", Module: "mod", OldType: 'D', NewType: 'T'},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("DiffSymbols:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSymbolTable(t *testing.T) {
+	t.Run("Stats", testSymbolTableStats)
+	t.Run("FindIn", testSymbolTableFindIn)
+	t.Run("FilterAddr", testSymbolTableFilterAddr)
+	t.Run("BySection", testSymbolTableBySection)
+	t.Run("Resolve", testSymbolTableResolve)
+	t.Run("ResolveExact", testSymbolTableResolveExact)
+	t.Run("ResolveString", testSymbolTableResolveString)
+	t.Run("Around", testSymbolTableAround)
+	t.Run("Validate", testSymbolTableValidate)
+	t.Run("WritePprofMap", testSymbolTableWritePprofMap)
+	t.Run("WriteTo", testSymbolTableWriteTo)
+	t.Run("WriteModule", testSymbolTableWriteModule)
+	t.Run("MapNames", testSymbolTableMapNames)
+	t.Run("WithKASLROffset", testSymbolTableWithKASLROffset)
+	t.Run("ModuleRange", testSymbolTableModuleRange)
+	t.Run("AddressHistogram", testSymbolTableAddressHistogram)
+}
+
+func testSymbolTableStats(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	got := symtab.Stats()
+	want := SymbolStats{
+		Text:        5,
+		Data:        2,
+		BSS:         2,
+		Readonly:    1,
+		Weak:        2,
+		Absolute:    1,
+		Other:       1,
+		Globals:     10,
+		Locals:      4,
+		ModuleCount: 2,
+	}
+	if got != want {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func testSymbolTableBySection(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	sections := symtab.BySection()
+	want := map[string][]string{
+		"text":   {"_stext", "do_one_initcall", "nf_hook_local", "nf_conntrack_in", "ext4_fill_super"},
+		"data":   {"init_task", "some_local_data"},
+		"bss":    {"jiffies_64", "local_bss"},
+		"rodata": {"linux_banner"},
+		"other":  {"irq_stack_union", "weak_function", "weak_object", "unique_global"},
+	}
+	got := make(map[string][]string)
+	for section, syms := range sections {
+		for _, sym := range syms {
+			got[section] = append(got[section], sym.Name)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("BySection: got %q, want %q", got, want)
+	}
+}
+
+func testSymbolTableFilterAddr(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	got := symtab.FilterAddr(func(addr uintptr) bool {
+		return addr >= 0xffffffff82300000 && addr%0x100000 == 0
+	})
+	var names []string
+	for _, sym := range got {
+		names = append(names, sym.Name)
+	}
+	want := []string{"jiffies_64", "weak_function", "unique_global", "ext4_fill_super"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("FilterAddr: got %q, want %q", names, want)
+	}
+	if got := symtab.FilterAddr(func(uintptr) bool { return false }); len(got) != 0 {
+		t.Fatalf("FilterAddr with false predicate: got %v", got)
+	}
+}
+
+func testSymbolTableFindIn(t *testing.T) {
+	symtab := mustParseSymbols(t, `ffffffff81000000 t cleanup
+ffffffff81000100 t cleanup
+ffffffffc0001000 t cleanup	[ext4]
+ffffffffc0002000 t cleanup	[xfs]`)
+	tests := []struct {
+		Module, Name string
+		WantAddr     uintptr
+		WantOK       bool
+	}{
+		{Module: "", Name: "cleanup", WantAddr: 0xffffffff81000000, WantOK: true},
+		{Module: "ext4", Name: "cleanup", WantAddr: 0xffffffffc0001000, WantOK: true},
+		{Module: "xfs", Name: "cleanup", WantAddr: 0xffffffffc0002000, WantOK: true},
+		{Module: "btrfs", Name: "cleanup", WantOK: false},
+		{Module: "ext4", Name: "missing", WantOK: false},
+	}
+	for _, tt := range tests {
+		sym, ok := symtab.FindIn(tt.Module, tt.Name)
+		if ok != tt.WantOK || (ok && (sym.Addr != tt.WantAddr || sym.Module != tt.Module || sym.Name != tt.Name)) {
+			t.Errorf("FindIn(%q, %q) = %v, %t, want address %#x, %t", tt.Module, tt.Name, sym, ok, tt.WantAddr, tt.WantOK)
+		}
+	}
+}
+
+var resolveTests = []struct {
+	Addr       uintptr
+	WantName   string
+	WantOffset uintptr
+	WantOK     bool
+}{
+	{Addr: 0xffffffff81000000, WantName: "_stext", WantOffset: 0, WantOK: true},
+	{Addr: 0xffffffff81000004, WantName: "_stext", WantOffset: 4, WantOK: true},
+	{Addr: 0xffffffff81000020, WantName: "do_one_initcall", WantOffset: 0x10, WantOK: true},
+	{Addr: 0xffffffffc0002150, WantName: "nf_conntrack_in", WantOffset: 0x50, WantOK: true},
+	{Addr: 0xffffffffffffffff, WantName: "ext4_fill_super", WantOffset: 0x3fefffff, WantOK: true},
+}
+
+func testSymbolTableResolve(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	for _, tt := range resolveTests {
+		sym, offset, ok := symtab.Resolve(tt.Addr)
+		if ok != tt.WantOK || sym.Name != tt.WantName || offset != tt.WantOffset {
+			t.Errorf("Resolve(%#x) = %v, %#x, %t, want %s, %#x, %t",
+				tt.Addr, sym, offset, ok, tt.WantName, tt.WantOffset, tt.WantOK)
+		}
+	}
+
+	symtab = mustParseSymbols(t, `0000000000001000 T b
+0000000000001000 T a`)
+	if _, _, ok := symtab.Resolve(0x10); ok {
+		t.Errorf("Resolve(0x10) succeeded below the lowest symbol")
+	}
+	if sym, _, _ := symtab.Resolve(0x1008); sym.Name != "a" {
+		t.Errorf("Resolve(0x1008) = %v, want a", sym)
+	}
+}
+
+func testSymbolTableResolveExact(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	for _, tt := range resolveTests {
+		sym, atStart, offset, ok := symtab.ResolveExact(tt.Addr)
+		if ok != tt.WantOK || sym.Name != tt.WantName || offset != tt.WantOffset {
+			t.Errorf("ResolveExact(%#x) = %v, %#x, %t, want %s, %#x, %t",
+				tt.Addr, sym, offset, ok, tt.WantName, tt.WantOffset, tt.WantOK)
+		}
+		if want := tt.WantOK && tt.WantOffset == 0; atStart != want {
+			t.Errorf("ResolveExact(%#x): atStart = %t, want %t", tt.Addr, atStart, want)
+		}
+	}
+	if _, atStart, _, ok := mustParseSymbols(t, "0000000000001000 T a").ResolveExact(0); ok || atStart {
+		t.Errorf("ResolveExact below the lowest symbol: atStart = %t, ok = %t", atStart, ok)
+	}
+}
+
+func testSymbolTableResolveString(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	tests := []struct {
+		In   string
+		Want string
+	}{
+		{In: "ffffffff81000000", Want: "_stext+0x0"},
+		{In: "0xffffffff81000018", Want: "do_one_initcall+0x8"},
+		{In: "0XFFFFFFFFC0002150", Want: "nf_conntrack_in+0x50 [nf_conntrack]"},
+	}
+	for _, tt := range tests {
+		got, err := symtab.ResolveString(tt.In)
+		if err != nil {
+			t.Errorf("ResolveString(%q): %v", tt.In, err)
+			continue
+		}
+		if got != tt.Want {
+			t.Errorf("ResolveString(%q) = %q, want %q", tt.In, got, tt.Want)
+		}
+	}
+	noLow := mustParseSymbols(t, "ffffffff81000000 T _stext")
+	for _, in := range []string{"", "0x", "zzzz", "ffffffff8100000000000", "-10"} {
+		if _, err := noLow.ResolveString(in); err == nil {
+			t.Errorf("ResolveString(%q) succeeded", in)
+		}
+	}
+	if _, err := noLow.ResolveString("0x1000"); err == nil {
+		t.Error("ResolveString succeeded below the lowest symbol")
+	}
+}
+
+func testSymbolTableAround(t *testing.T) {
+	symtab := mustParseSymbols(t, `0000000000001000 T a
+0000000000001010 T b
+0000000000001020 T c
+0000000000001030 T d
+0000000000001040 T e`)
+	tests := []struct {
+		Addr uintptr
+		K    int
+		Want []string
+	}{
+		{Addr: 0x1020, K: 3, Want: []string{"c", "b", "d"}},
+		{Addr: 0x1018, K: 2, Want: []string{"b", "c"}},
+		{Addr: 0x1019, K: 3, Want: []string{"c", "b", "d"}},
+		{Addr: 0x0, K: 2, Want: []string{"a", "b"}},
+		{Addr: 0x2000, K: 2, Want: []string{"e", "d"}},
+		{Addr: 0x1020, K: 10, Want: []string{"c", "b", "d", "a", "e"}},
+		{Addr: 0x1020, K: 0, Want: nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, sym := range symtab.Around(tt.Addr, tt.K) {
+			got = append(got, sym.Name)
+		}
+		if !reflect.DeepEqual(got, tt.Want) {
+			t.Errorf("Around(%#x, %d) = %q, want %q", tt.Addr, tt.K, got, tt.Want)
+		}
+	}
+}
+
+func testSymbolTableValidate(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	if errs := symtab.Validate(); errs != nil {
+		t.Fatalf("Validate() on well-formed table: %v", errs)
+	}
+
+	symtab = mustParseSymbols(t, `0000000000001000 T dup
+0000000000002000 T dup
+0000000000002000 W dup
+0000000000003000 t local_dup
+0000000000004000 t local_dup
+0000000000005000 T dup	[mod]`)
+	errs := symtab.Validate()
+	if len(errs) != 1 {
+		t.Fatalf("Validate() = %v, want exactly one error", errs)
+	}
+	if !strings.Contains(errs[0].Error(), `"dup"`) {
+		t.Fatalf("error %q does not mention the duplicate symbol", errs[0])
+	}
+}
+
+func testSymbolTableWritePprofMap(t *testing.T) {
+	symtab := mustParseSymbols(t, `0000000000000000 A abs
+0000000000001000 T a
+0000000000001000 t a_alias
+0000000000001010 T b
+0000000000001040 T c`)
+	buf := new(bytes.Buffer)
+	n, err := symtab.WritePprofMap(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0000000000001000 0000000000001010 a\n" +
+		"0000000000001000 0000000000001010 a_alias\n" +
+		"0000000000001010 0000000000001040 b\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("WritePprofMap() => %q, want %q", got, want)
+	}
+	if n != int64(len(want)) {
+		t.Fatalf("WritePprofMap() reported %d bytes, wrote %d", n, len(want))
+	}
+
+	// At the boundary between the kernel image and modules, or between
+	// modules, the last symbol on either side of the gap is omitted.
+	buf.Reset()
+	symtab = mustParseSymbols(t, `ffffffff81000000 T _stext
+ffffffff81000010 T last_builtin
+ffffffffc0002000 t nf_hook_local	[nf_conntrack]
+ffffffffc0002100 T nf_conntrack_in	[nf_conntrack]
+ffffffffc0100000 T ext4_fill_super	[ext4]
+ffffffffc0100040 T ext4_put_super	[ext4]`)
+	if _, err := symtab.WritePprofMap(buf); err != nil {
+		t.Fatal(err)
+	}
+	want = "ffffffff81000000 ffffffff81000010 _stext\n" +
+		"ffffffffc0002000 ffffffffc0002100 nf_hook_local\n" +
+		"ffffffffc0100000 ffffffffc0100040 ext4_fill_super\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("WritePprofMap() => %q, want %q", got, want)
+	}
+}
+
+func testSymbolTableMapNames(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	mapped := symtab.MapNames(func(sym Symbol) string {
+		if sym.IsModule() {
+			return "v1_" + sym.Name
+		}
+		return sym.Name
+	})
+	if len(mapped) != len(symtab) {
+		t.Fatalf("MapNames: got %d symbols, want %d", len(mapped), len(symtab))
+	}
+	if got := mapped.Find("v1_nf_conntrack_in"); len(got) != 1 || got[0].Module != "nf_conntrack" {
+		t.Fatalf(`Find("v1_nf_conntrack_in") = %v, want one symbol in nf_conntrack`, got)
+	}
+	if got := mapped.Find("_stext"); len(got) != 1 {
+		t.Fatalf(`Find("_stext") = %v, want one symbol`, got)
+	}
+	if got := symtab.Find("v1_nf_conntrack_in"); len(got) != 0 {
+		t.Fatalf("MapNames modified the original table: found %v", got)
+	}
+}
+
+func testSymbolTableModuleRange(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	tests := []struct {
+		Module string
+		Lo, Hi uintptr
+		OK     bool
+	}{
+		{Module: "nf_conntrack", Lo: 0xffffffffc0002000, Hi: 0xffffffffc0002100, OK: true},
+		{Module: "ext4", Lo: 0xffffffffc0100000, Hi: 0xffffffffc0100000, OK: true},
+		{Module: "xfs", OK: false},
+	}
+	for _, tt := range tests {
+		lo, hi, ok := symtab.ModuleRange(tt.Module)
+		if lo != tt.Lo || hi != tt.Hi || ok != tt.OK {
+			t.Errorf("ModuleRange(%q) = %#x, %#x, %t, want %#x, %#x, %t",
+				tt.Module, lo, hi, ok, tt.Lo, tt.Hi, tt.OK)
+		}
+	}
+}
+
+func testSymbolTableAddressHistogram(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	got := symtab.AddressHistogram(0x100000)
+	want := map[uintptr]int{
+		0x0000000000000000: 1,
+		0xffffffff81000000: 2,
+		0xffffffff82000000: 1,
+		0xffffffff82100000: 1,
+		0xffffffff82200000: 1,
+		0xffffffff82300000: 2,
+		0xffffffff82400000: 2,
+		0xffffffff82500000: 1,
+		0xffffffffc0000000: 2,
+		0xffffffffc0100000: 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("AddressHistogram(0x100000) = %#v, want %#v", got, want)
+	}
+
+	got = symtab.AddressHistogram(0)
+	if !reflect.DeepEqual(got, symtab.AddressHistogram(DefaultBucketSize)) {
+		t.Fatalf("AddressHistogram(0) does not use DefaultBucketSize: got %#v", got)
+	}
+	if got[0xffffffffc0002000] != 2 {
+		t.Fatalf("AddressHistogram(0): got %d symbols at 0xffffffffc0002000, want 2", got[0xffffffffc0002000])
+	}
+}
+
+func testSymbolTableWriteTo(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols+"ffffffffc0002000 t with_extra\t[mod] extra\n")
+	buf := new(bytes.Buffer)
+	n, err := symtab.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo returned %d, but wrote %d bytes", n, buf.Len())
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if got, want := lines[0], "0000000000000000 A irq_stack_union"; got != want {
+		t.Errorf("first line = %q, want %q", got, want)
+	}
+	if got, want := lines[len(lines)-1], "ffffffffc0100000 T ext4_fill_super\t[ext4]"; got != want {
+		t.Errorf("last line = %q, want %q", got, want)
+	}
+	reparsed, err := ReadSymbols(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reparsed, symtab) {
+		t.Fatalf("round trip: got %v, want %v", reparsed, symtab)
+	}
+}
+
+func testSymbolTableWriteModule(t *testing.T) {
+	symtab := mustParseSymbols(t, testSymbols)
+	for _, module := range []string{"", "ext4", "nf_conntrack", "nonexistent"} {
+		buf := new(bytes.Buffer)
+		n, err := symtab.WriteModule(buf, module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(buf.Len()) {
+			t.Fatalf("WriteModule returned %d, but wrote %d bytes", n, buf.Len())
+		}
+		got, err := ReadSymbols(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make(SymbolTable)
+		for sym := range symtab {
+			if sym.Module == module {
+				want[sym] = struct{}{}
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("module %q: got %v, want %v", module, got, want)
+		}
+		if _, _, ok := symtab.ModuleRange(module); ok != (len(got) > 0) {
+			t.Errorf("module %q: ModuleRange reports %t, but wrote %d symbols", module, ok, len(got))
+		}
+	}
+}
+
+func testSymbolTableWithKASLROffset(t *testing.T) {
+	offline := mustParseSymbols(t, testSymbols)
+	const runtimeStext = 0xffffffff9a000000
+	stext, ok := offline.FindIn("", "_stext")
+	if !ok {
+		t.Fatal("_stext not found")
+	}
+	slide := uintptr(runtimeStext) - stext.Addr
+	slid := offline.WithKASLROffset(slide)
+	if len(slid) != len(offline) {
+		t.Fatalf("got %d symbols, want %d", len(slid), len(offline))
+	}
+
+	tests := []struct {
+		Module, Name string
+		Want         uintptr
+	}{
+		{Module: "", Name: "_stext", Want: runtimeStext},
+		{Module: "", Name: "jiffies_64", Want: 0xffffffff82300000 + slide},
+		{Module: "", Name: "irq_stack_union", Want: 0},
+		{Module: "ext4", Name: "ext4_fill_super", Want: 0xffffffffc0100000},
+	}
+	for _, tt := range tests {
+		sym, ok := slid.FindIn(tt.Module, tt.Name)
+		if !ok || sym.Addr != tt.Want {
+			t.Errorf("%s: got %v, %t, want address %#x", tt.Name, sym, ok, tt.Want)
+		}
+	}
+
+	// A negative slide works by wrapping around.
+	back := slid.WithKASLROffset(-slide)
+	if !reflect.DeepEqual(back, offline) {
+		t.Fatalf("sliding back: got %v, want %v", back, offline)
+	}
+}
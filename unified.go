@@ -0,0 +1,164 @@
+// Copyright 2019 Andrei Tudor Călin
+//
+// Permission to use, copy, modify, and/or distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package linuxkernel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// unifiedContext is the number of lines of context around each hunk
+// written by UnifiedDiff.
+const unifiedContext = 3
+
+// UnifiedDiff writes the differences between the canonical serializations
+// of old and new, as produced by WriteTo, to w, in unified diff format, as
+// produced by diff -u. The file names in the header are "old" and "new".
+// If the configurations are Equal, nothing is written.
+//
+// Since the serializations are sorted by option name, a changed option
+// always shows up as a removed line followed by an added line, and the
+// diff is computed by merging the two, rather than by a general purpose
+// diff algorithm.
+func UnifiedDiff(old, new Config, w io.Writer) error {
+	lines := unifiedLines(old, new)
+
+	// Find the hunks: runs of changed lines, separated by at most
+	// 2*unifiedContext unchanged lines, extended by unifiedContext
+	// unchanged lines on either side.
+	type hunk struct{ start, end int }
+	var hunks []hunk
+	for i, line := range lines {
+		if line.Op == ' ' {
+			continue
+		}
+		if n := len(hunks); n > 0 && i-hunks[n-1].end <= 2*unifiedContext {
+			hunks[n-1].end = i + 1
+		} else {
+			hunks = append(hunks, hunk{start: i, end: i + 1})
+		}
+	}
+	if len(hunks) == 0 {
+		return nil
+	}
+
+	uw := &unifiedWriter{W: w}
+	uw.Printf("--- old\n+++ new\n")
+	for _, h := range hunks {
+		start := h.start - unifiedContext
+		if start < 0 {
+			start = 0
+		}
+		end := h.end + unifiedContext
+		if end > len(lines) {
+			end = len(lines)
+		}
+		oldstart, oldcount := lines[start].OldLine, 0
+		newstart, newcount := lines[start].NewLine, 0
+		for _, line := range lines[start:end] {
+			if line.Op != '+' {
+				oldcount++
+			}
+			if line.Op != '-' {
+				newcount++
+			}
+		}
+		uw.Printf("@@ -%s +%s @@\n", hunkRange(oldstart, oldcount), hunkRange(newstart, newcount))
+		for _, line := range lines[start:end] {
+			uw.Printf("%c%s\n", line.Op, line.Text)
+		}
+	}
+	return uw.Err
+}
+
+// unifiedLine is a line in the merged serializations of two configurations.
+type unifiedLine struct {
+	Op   byte // ' ', '-' or '+'
+	Text string
+
+	// OldLine and NewLine are the 1-based numbers of the line, or of the
+	// next line, in the old and the new serializations, respectively.
+	OldLine, NewLine int
+}
+
+// unifiedLines merges the canonical serializations of old and new.
+func unifiedLines(old, new Config) []unifiedLine {
+	oldlines := serializedLines(old)
+	newlines := serializedLines(new)
+	oldopts := old.sortedOptions()
+	newopts := new.sortedOptions()
+
+	var lines []unifiedLine
+	i, j := 0, 0
+	emit := func(op byte, text string) {
+		lines = append(lines, unifiedLine{Op: op, Text: text, OldLine: i + 1, NewLine: j + 1})
+	}
+	for i < len(oldopts) || j < len(newopts) {
+		switch {
+		case j == len(newopts) || (i < len(oldopts) && oldopts[i] < newopts[j]):
+			emit('-', oldlines[i])
+			i++
+		case i == len(oldopts) || newopts[j] < oldopts[i]:
+			emit('+', newlines[j])
+			j++
+		case oldlines[i] == newlines[j]:
+			emit(' ', oldlines[i])
+			i++
+			j++
+		default:
+			emit('-', oldlines[i])
+			i++
+			emit('+', newlines[j])
+			j++
+		}
+	}
+	return lines
+}
+
+// serializedLines returns the lines written by cfg.WriteTo, one per
+// option, in sorted order.
+func serializedLines(cfg Config) []string {
+	buf := new(bytes.Buffer)
+	cfg.WriteTo(buf) // writes to a bytes.Buffer never fail
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[:len(cfg)]
+}
+
+// hunkRange formats the range of a hunk, as in a unified diff hunk header.
+// Empty ranges start at the line preceding the hunk, and ranges of a single
+// line omit the count.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprintf("%d", start)
+	default:
+		return fmt.Sprintf("%d,%d", start, count)
+	}
+}
+
+type unifiedWriter struct {
+	W   io.Writer
+	Err error // sticky
+}
+
+func (uw *unifiedWriter) Printf(format string, args ...interface{}) {
+	if uw.Err != nil {
+		return
+	}
+	_, uw.Err = fmt.Fprintf(uw.W, format, args...)
+}